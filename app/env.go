@@ -2,7 +2,11 @@ package app
 
 import (
 	oas "github.com/charmixer/oas/exporter"
-	cache "github.com/patrickmn/go-cache"
+
+	"github.com/wraix/device-flow-proxy/bruteforce"
+	"github.com/wraix/device-flow-proxy/client"
+	"github.com/wraix/device-flow-proxy/provider"
+	"github.com/wraix/device-flow-proxy/store"
 )
 
 type Environment struct {
@@ -21,15 +25,23 @@ type Environment struct {
 
 	OpenAPI oas.Openapi
 
-	BaseUrl               string
-	AuthorizationEndpoint string
-	TokenEndpoint         string
+	BaseUrl string
+
+	Clients   *client.Registry
+	Providers *provider.Registry
 
 	PollIntervalInSeconds int
+	MaxSlowDowns          int
 
 	CacheDefaultExpiration int
+	TombstoneExpiration    int
 	CachePurgeExpired      int
-	Cache                  *cache.Cache
+	Store                  store.FlowStore
+
+	// BruteForce locks out browsers entering too many wrong user codes
+	BruteForce *bruteforce.Guard
+	// ClientIpHeader is the header a reverse proxy puts the address of the browser in, the remote address is used when empty
+	ClientIpHeader string
 }
 
 var Env Environment
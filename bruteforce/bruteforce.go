@@ -0,0 +1,184 @@
+package bruteforce
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+
+	"github.com/wraix/device-flow-proxy/store"
+)
+
+// ErrLockedOut is returned by Guard.Reserve when too many wrong user codes were entered.
+var ErrLockedOut = errors.New("bruteforce: locked out after too many failed attempts")
+
+// ErrChallengeFailed is returned by a Challenge when the answer to it is missing or wrong.
+var ErrChallengeFailed = errors.New("bruteforce: challenge not passed")
+
+var (
+	failedLookups = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "user_code_failed_lookups_total",
+		Help: "Number of user codes entered that did not match a pending flow.",
+	})
+	lockedOut = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "user_code_locked_out_total",
+		Help: "Number of user code entries rejected because of too many failed attempts.",
+	})
+	failedChallenges = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "user_code_failed_challenges_total",
+		Help: "Number of user code entries rejected because the challenge was not passed.",
+	})
+)
+
+// Policy decides how long entering user codes is locked after entering wrong ones.
+type Policy struct {
+	// FreeAttempts is how many wrong codes may be entered before being locked out.
+	FreeAttempts int
+	// Lockout is how long the first lockout lasts. It doubles with every further wrong code, up to MaxLockout.
+	Lockout    time.Duration
+	MaxLockout time.Duration
+	// Window is how long wrong codes are counted after the last one.
+	Window time.Duration
+}
+
+// LockedUntil returns when codes may be entered again after the given failed attempts, which is in the past when not locked out.
+func (p Policy) LockedUntil(attempts store.Attempts) time.Time {
+	over := attempts.Failures - p.FreeAttempts
+	if over <= 0 {
+		return time.Time{}
+	}
+
+	lockout := p.Lockout
+	for i := 1; i < over && lockout < p.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > p.MaxLockout {
+		lockout = p.MaxLockout
+	}
+	return attempts.LastFailedAt.Add(lockout)
+}
+
+// Challenge lets the user prove to be human before entering a code, eg. by solving a CAPTCHA.
+type Challenge interface {
+	// Form returns the html added to the user code form, eg. the CAPTCHA widget.
+	Form() template.HTML
+	// Verify checks the answer to the challenge sent along with the user code, returning ErrChallengeFailed when it is wrong.
+	Verify(ctx context.Context, r *http.Request) error
+}
+
+// Guard counts wrong user codes by keys identifying who entered them, eg. an IP address and a browser session,
+// and locks them out from entering more when too many were wrong.
+type Guard struct {
+	store  store.FlowStore
+	policy Policy
+	// Challenge must be passed by keys having entered a wrong code, when set.
+	Challenge Challenge
+}
+
+// NewGuard creates a guard counting failed attempts in s.
+func NewGuard(s store.FlowStore, policy Policy) *Guard {
+	return &Guard{
+		store:  s,
+		policy: policy,
+	}
+}
+
+// Reservation is an attempt counted by Guard.Reserve, which is refunded with Guard.Refund when the code entered was right.
+type Reservation struct {
+	// LockedUntil is when codes may be entered again, when Reserve returned ErrLockedOut.
+	LockedUntil time.Time
+
+	keys []string
+	at   time.Time
+	// previous are the attempts counted for each of keys before this one.
+	previous []store.Attempts
+}
+
+// Reserve counts an attempt by keys to enter a code at the given time, before the code is looked up. When any of
+// them was locked out by the attempts before it, the attempt is refunded and ErrLockedOut is returned along with when
+// they may try again. Attempts are counted first so that parallel attempts cannot all pass before any is counted.
+//
+// The attempt stays counted as a wrong code, unless it is refunded with Refund.
+func (g *Guard) Reserve(ctx context.Context, keys []string, now time.Time) (Reservation, error) {
+	reservation := Reservation{at: now}
+	for _, key := range keys {
+		previous, err := g.store.ReserveAttempt(ctx, key, now, g.policy.Window)
+		if err != nil {
+			g.refund(ctx, reservation)
+			return Reservation{}, err
+		}
+		reservation.keys = append(reservation.keys, key)
+		reservation.previous = append(reservation.previous, previous)
+
+		if until := g.policy.LockedUntil(previous); until.After(reservation.LockedUntil) {
+			reservation.LockedUntil = until
+		}
+	}
+
+	if reservation.LockedUntil.After(now) {
+		lockedOut.Inc()
+		if err := g.Refund(ctx, reservation); err != nil {
+			return Reservation{}, err
+		}
+		return reservation, ErrLockedOut
+	}
+	return reservation, nil
+}
+
+// Refund uncounts a reserved attempt, when the code entered was right. The lockout is left as it was before the attempt.
+func (g *Guard) Refund(ctx context.Context, reservation Reservation) error {
+	for i, key := range reservation.keys {
+		if err := g.store.RefundAttempt(ctx, key, reservation.at, reservation.previous[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refund uncounts an attempt when reserving it failed halfway, for which there is nothing more to do than logging when
+// refunding fails too.
+func (g *Guard) refund(ctx context.Context, reservation Reservation) {
+	if err := g.Refund(ctx, reservation); err != nil {
+		log.Error().Err(err).Msg("Unable to refund user code attempt")
+	}
+}
+
+// ChallengeRequired tells if any of keys has entered a wrong code, and must pass the challenge before entering another.
+func (g *Guard) ChallengeRequired(ctx context.Context, keys []string) (bool, error) {
+	if g.Challenge == nil {
+		return false, nil
+	}
+
+	for _, key := range keys {
+		attempts, err := g.store.GetAttempts(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		if attempts.Failures > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// VerifyChallenge checks the answer to the challenge sent with r.
+func (g *Guard) VerifyChallenge(ctx context.Context, r *http.Request) error {
+	if err := g.Challenge.Verify(ctx, r); err != nil {
+		failedChallenges.Inc()
+		return err
+	}
+	return nil
+}
+
+// Fail records that the code entered with a reserved attempt was wrong, which leaves the attempt counted.
+//
+// Codes entered right are refunded, but do not reset the count, as an attacker could otherwise start flows of their
+// own to enter a right code between every guess.
+func (g *Guard) Fail() {
+	failedLookups.Inc()
+}
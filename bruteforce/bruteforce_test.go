@@ -0,0 +1,141 @@
+package bruteforce
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wraix/device-flow-proxy/store"
+)
+
+func TestPolicyLockedUntil(t *testing.T) {
+	policy := Policy{FreeAttempts: 3, Lockout: 30 * time.Second, MaxLockout: 2 * time.Minute}
+	at := time.Now()
+
+	tests := map[int]time.Duration{
+		0: 0,
+		3: 0,
+		4: 30 * time.Second,
+		5: time.Minute,
+		6: 2 * time.Minute,
+		9: 2 * time.Minute,
+	}
+	for failures, lockout := range tests {
+		got := policy.LockedUntil(store.Attempts{Failures: failures, LastFailedAt: at})
+		if lockout == 0 && got.After(at) {
+			t.Errorf("%d failures locked out until %v, want not locked out", failures, got)
+		}
+		if lockout > 0 && !got.Equal(at.Add(lockout)) {
+			t.Errorf("%d failures locked out for %v, want %v", failures, got.Sub(at), lockout)
+		}
+	}
+}
+
+func TestGuard(t *testing.T) {
+	ctx := context.Background()
+	g := NewGuard(store.NewMemoryStore(time.Minute, time.Minute), Policy{FreeAttempts: 2, Lockout: time.Minute, MaxLockout: time.Hour, Window: time.Hour})
+
+	attacker := []string{"ip:192.0.2.1", "session:a"}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := g.Reserve(ctx, attacker, now); err != nil {
+			t.Fatalf("Reserve attempt %d: %v", i+1, err)
+		}
+		g.Fail()
+	}
+
+	// A new session from the same address is still locked out
+	reservation, err := g.Reserve(ctx, []string{"ip:192.0.2.1", "session:b"}, now)
+	if !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("Reserve after too many failures returned %v, want ErrLockedOut", err)
+	}
+	if !reservation.LockedUntil.Equal(now.Add(time.Minute)) {
+		t.Fatalf("locked out until %v, want a minute", reservation.LockedUntil.Sub(now))
+	}
+	reservation, err = g.Reserve(ctx, attacker, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Reserve after lockout returned %v", err)
+	}
+	// A right code is refunded, leaving the count as it was
+	if err := g.Refund(ctx, reservation); err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	attempts, err := g.store.GetAttempts(ctx, "ip:192.0.2.1")
+	if err != nil {
+		t.Fatalf("GetAttempts: %v", err)
+	}
+	if attempts.Failures != 3 {
+		t.Fatalf("%d failures after refund, want 3", attempts.Failures)
+	}
+
+	if _, err := g.Reserve(ctx, []string{"ip:192.0.2.2", "session:c"}, now); err != nil {
+		t.Fatalf("Reserve of another address returned %v", err)
+	}
+}
+
+func TestGuardRefundKeepsLockout(t *testing.T) {
+	ctx := context.Background()
+	g := NewGuard(store.NewMemoryStore(time.Minute, time.Minute), Policy{FreeAttempts: 2, Lockout: time.Minute, MaxLockout: time.Hour, Window: time.Hour})
+
+	user := []string{"ip:192.0.2.1", "session:a"}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := g.Reserve(ctx, user, now); err != nil {
+			t.Fatalf("Reserve attempt %d: %v", i+1, err)
+		}
+		g.Fail()
+	}
+
+	// Retrying while locked out does not start the lockout over
+	if _, err := g.Reserve(ctx, user, now.Add(30*time.Second)); !errors.Is(err, ErrLockedOut) {
+		t.Fatalf("Reserve while locked out returned %v, want ErrLockedOut", err)
+	}
+
+	// Neither does a right code entered once the lockout is over, so the next wrong code is still let through
+	reservation, err := g.Reserve(ctx, user, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Reserve after lockout returned %v", err)
+	}
+	if err := g.Refund(ctx, reservation); err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	if _, err := g.Reserve(ctx, user, now.Add(time.Minute+time.Second)); err != nil {
+		t.Fatalf("Reserve after a right code returned %v, the lockout started over", err)
+	}
+}
+
+func TestGuardConcurrentReserve(t *testing.T) {
+	ctx := context.Background()
+	policy := Policy{FreeAttempts: 3, Lockout: time.Minute, MaxLockout: time.Hour, Window: time.Hour}
+	g := NewGuard(store.NewMemoryStore(time.Minute, time.Minute), policy)
+
+	attacker := []string{"ip:192.0.2.1", "session:a"}
+	now := time.Now()
+	const n = 20
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := g.Reserve(ctx, attacker, now)
+			if err == nil {
+				atomic.AddInt32(&allowed, 1)
+				g.Fail()
+				return
+			}
+			if !errors.Is(err, ErrLockedOut) {
+				t.Errorf("Reserve: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Only the free attempts and the one locking out may pass, however many are made at once
+	if allowed != int32(policy.FreeAttempts+1) {
+		t.Fatalf("%d of %d parallel attempts allowed, want %d", allowed, n, policy.FreeAttempts+1)
+	}
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+// Client authentication methods, see https://datatracker.ietf.org/doc/html/rfc7591#section-2
+const (
+	AuthMethodNone              = "none"
+	AuthMethodClientSecretBasic = "client_secret_basic"
+	AuthMethodClientSecretPost  = "client_secret_post"
+	AuthMethodPrivateKeyJwt     = "private_key_jwt"
+)
+
+// AuthMethods are the authentication methods clients may register with.
+var AuthMethods = []string{AuthMethodNone, AuthMethodClientSecretBasic, AuthMethodClientSecretPost, AuthMethodPrivateKeyJwt}
+
+// AssertionSigningAlgorithms are the algorithms client assertions may be signed with. Only asymmetric algorithms
+// are accepted, as assertions are verified with the public keys of the client.
+var AssertionSigningAlgorithms = []string{
+	string(jose.RS256), string(jose.RS384), string(jose.RS512),
+	string(jose.PS256), string(jose.PS384), string(jose.PS512),
+	string(jose.ES256), string(jose.ES384), string(jose.ES512),
+	string(jose.EdDSA),
+}
+
+// ClientAssertionTypeJwtBearer is the client_assertion_type of private_key_jwt, see https://datatracker.ietf.org/doc/html/rfc7523#section-2.2
+const ClientAssertionTypeJwtBearer = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// ErrAuthenticationFailed is returned when a client presents wrong credentials or authenticates with another method than registered.
+var ErrAuthenticationFailed = errors.New("client: authentication failed")
+
+// Credentials are what a client presented to authenticate, see https://datatracker.ietf.org/doc/html/rfc6749#section-2.3
+type Credentials struct {
+	// Method is the authentication method the credentials were presented with
+	Method   string
+	ClientId string
+	// Secret is the client secret of client_secret_basic and client_secret_post
+	Secret string
+	// Assertion is the signed jwt of private_key_jwt
+	Assertion string
+}
+
+// Authenticate returns the client the credentials belong to. Assertions must be addressed to one of audiences.
+func (r *Registry) Authenticate(credentials Credentials, audiences []string, now time.Time) (Client, error) {
+	clientId := credentials.ClientId
+
+	var assertion *jwt.JSONWebToken
+	if credentials.Method == AuthMethodPrivateKeyJwt {
+		var err error
+		assertion, err = jwt.ParseSigned(credentials.Assertion)
+		if err != nil {
+			return Client{}, fmt.Errorf("%w: %s", ErrAuthenticationFailed, err)
+		}
+
+		// The subject names the client whose keys verify the assertion, so it can only be trusted once verified below
+		unverified := jwt.Claims{}
+		if err := assertion.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+			return Client{}, fmt.Errorf("%w: %s", ErrAuthenticationFailed, err)
+		}
+		if clientId == "" {
+			clientId = unverified.Subject
+		}
+		if unverified.Subject != clientId {
+			return Client{}, fmt.Errorf("%w: assertion subject is not the client", ErrAuthenticationFailed)
+		}
+	}
+
+	c, err := r.Get(clientId)
+	if err != nil {
+		return Client{}, err
+	}
+
+	method := c.AuthMethod
+	if method == "" {
+		method = AuthMethodNone
+	}
+	if credentials.Method != method {
+		return Client{}, fmt.Errorf("%w: client must authenticate with %s", ErrAuthenticationFailed, method)
+	}
+
+	switch method {
+	case AuthMethodClientSecretBasic, AuthMethodClientSecretPost:
+		if subtle.ConstantTimeCompare([]byte(credentials.Secret), []byte(c.Secret)) != 1 {
+			return Client{}, fmt.Errorf("%w: wrong client secret", ErrAuthenticationFailed)
+		}
+	case AuthMethodPrivateKeyJwt:
+		if err := c.verifyAssertion(assertion, audiences, now); err != nil {
+			return Client{}, fmt.Errorf("%w: %s", ErrAuthenticationFailed, err)
+		}
+	}
+
+	return c, nil
+}
+
+// verifyAssertion checks the signature and claims of a client assertion, see https://datatracker.ietf.org/doc/html/rfc7523#section-3
+func (c Client) verifyAssertion(assertion *jwt.JSONWebToken, audiences []string, now time.Time) error {
+	if c.JWKS == nil {
+		return errors.New("client has no keys")
+	}
+
+	if len(assertion.Headers) == 0 || !contains(AssertionSigningAlgorithms, assertion.Headers[0].Algorithm) {
+		return errors.New("assertion not signed with a supported algorithm")
+	}
+
+	keys := c.JWKS.Keys
+	if assertion.Headers[0].KeyID != "" {
+		keys = c.JWKS.Key(assertion.Headers[0].KeyID)
+	}
+
+	claims := jwt.Claims{}
+	verified := false
+	for _, key := range keys {
+		// Only public keys are trusted, a shared symmetric key would let anyone holding the JWKS sign assertions
+		if !key.IsPublic() {
+			continue
+		}
+		if err := assertion.Claims(key.Key, &claims); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errors.New("assertion not signed by a key of the client")
+	}
+
+	if claims.Expiry == nil {
+		return errors.New("assertion has no expiry")
+	}
+	if err := claims.ValidateWithLeeway(jwt.Expected{Issuer: c.Id, Subject: c.Id, Time: now}, jwt.DefaultLeeway); err != nil {
+		return err
+	}
+
+	for _, audience := range audiences {
+		if claims.Audience.Contains(audience) {
+			return nil
+		}
+	}
+	return errors.New("assertion is not addressed to the proxy")
+}
+
+// parseJWKS reads a JSON Web Key Set, see https://datatracker.ietf.org/doc/html/rfc7517#section-5
+func parseJWKS(data []byte) (*jose.JSONWebKeySet, error) {
+	jwks := jose.JSONWebKeySet{}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+	if len(jwks.Keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+	return &jwks, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+func TestAuthenticateSecret(t *testing.T) {
+	r := NewStrictRegistry(testDefaults,
+		Client{Id: "public"},
+		Client{Id: "basic", AuthMethod: AuthMethodClientSecretBasic, Secret: "secret"},
+		Client{Id: "post", AuthMethod: AuthMethodClientSecretPost, Secret: "secret"},
+	)
+	now := time.Now()
+
+	tests := []struct {
+		credentials Credentials
+		want        error
+	}{
+		{Credentials{Method: AuthMethodNone, ClientId: "public"}, nil},
+		{Credentials{Method: AuthMethodClientSecretBasic, ClientId: "basic", Secret: "secret"}, nil},
+		{Credentials{Method: AuthMethodClientSecretPost, ClientId: "post", Secret: "secret"}, nil},
+		{Credentials{Method: AuthMethodClientSecretBasic, ClientId: "basic", Secret: "wrong"}, ErrAuthenticationFailed},
+		{Credentials{Method: AuthMethodClientSecretPost, ClientId: "basic", Secret: "secret"}, ErrAuthenticationFailed},
+		{Credentials{Method: AuthMethodNone, ClientId: "basic"}, ErrAuthenticationFailed},
+		{Credentials{Method: AuthMethodClientSecretBasic, ClientId: "public", Secret: "secret"}, ErrAuthenticationFailed},
+		{Credentials{Method: AuthMethodNone, ClientId: "unknown"}, ErrUnknownClient},
+	}
+	for _, test := range tests {
+		c, err := r.Authenticate(test.credentials, nil, now)
+		if !errors.Is(err, test.want) {
+			t.Errorf("Authenticate(%+v) returned %v, want %v", test.credentials, err, test.want)
+		}
+		if err == nil && c.Id != test.credentials.ClientId {
+			t.Errorf("Authenticate(%+v) returned client %s", test.credentials, c.Id)
+		}
+	}
+}
+
+func TestAuthenticatePrivateKeyJwt(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	jwks := &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: "1", Algorithm: string(jose.ES256), Use: "sig"}}}
+	r := NewStrictRegistry(testDefaults, Client{Id: "kiosk", AuthMethod: AuthMethodPrivateKeyJwt, JWKS: jwks})
+
+	now := time.Now()
+	sign := func(signingKey *ecdsa.PrivateKey, claims jwt.Claims) string {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: signingKey}, (&jose.SignerOptions{}).WithHeader("kid", "1"))
+		if err != nil {
+			t.Fatalf("NewSigner: %v", err)
+		}
+		assertion, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+		if err != nil {
+			t.Fatalf("CompactSerialize: %v", err)
+		}
+		return assertion
+	}
+	valid := jwt.Claims{
+		Issuer:   "kiosk",
+		Subject:  "kiosk",
+		Audience: jwt.Audience{"https://proxy/device/code"},
+		Expiry:   jwt.NewNumericDate(now.Add(time.Minute)),
+		ID:       "1",
+	}
+	audiences := []string{"https://proxy", "https://proxy/device/code"}
+
+	c, err := r.Authenticate(Credentials{Method: AuthMethodPrivateKeyJwt, Assertion: sign(key, valid)}, audiences, now)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if c.Id != "kiosk" {
+		t.Fatalf("Authenticate returned client %s", c.Id)
+	}
+
+	expired := valid
+	expired.Expiry = jwt.NewNumericDate(now.Add(-time.Hour))
+	otherAudience := valid
+	otherAudience.Audience = jwt.Audience{"https://elsewhere"}
+	otherIssuer := valid
+	otherIssuer.Issuer = "someone"
+
+	symmetric, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("0123456789abcdef0123456789abcdef")}, nil)
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+	hmac, err := jwt.Signed(symmetric).Claims(valid).CompactSerialize()
+	if err != nil {
+		t.Fatalf("CompactSerialize: %v", err)
+	}
+
+	failing := map[string]Credentials{
+		"symmetric algorithm": {Method: AuthMethodPrivateKeyJwt, Assertion: hmac},
+		"wrong key":           {Method: AuthMethodPrivateKeyJwt, Assertion: sign(other, valid)},
+		"expired":             {Method: AuthMethodPrivateKeyJwt, Assertion: sign(key, expired)},
+		"other audience":      {Method: AuthMethodPrivateKeyJwt, Assertion: sign(key, otherAudience)},
+		"other issuer":        {Method: AuthMethodPrivateKeyJwt, Assertion: sign(key, otherIssuer)},
+		"other client":        {Method: AuthMethodPrivateKeyJwt, ClientId: "tv", Assertion: sign(key, valid)},
+		"not a jwt":           {Method: AuthMethodPrivateKeyJwt, Assertion: "garbage"},
+	}
+	for name, credentials := range failing {
+		if _, err := r.Authenticate(credentials, audiences, now); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("Authenticate with %s returned %v, want ErrAuthenticationFailed", name, err)
+		}
+	}
+}
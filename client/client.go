@@ -0,0 +1,174 @@
+package client
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/go-jose/go-jose/v3"
+)
+
+// ErrUnknownClient is returned for clients not in a registry that only allows known clients.
+var ErrUnknownClient = errors.New("client: unknown client")
+
+// Client is the configuration of a device client known to the proxy.
+type Client struct {
+	Id string
+	// Name is shown to users when they sign in on behalf of the client.
+	Name string
+	// AuthMethod is how the client authenticates to the proxy, see https://datatracker.ietf.org/doc/html/rfc7591#section-2
+	// Public clients do not authenticate, which is the same as AuthMethodNone.
+	AuthMethod string
+	// Secret is the client secret of client_secret_basic and client_secret_post, which the proxy also uses
+	// to authenticate the client to the upstream token endpoint.
+	Secret string
+	// JWKS holds the public keys that verify the assertions of private_key_jwt.
+	JWKS *jose.JSONWebKeySet
+	// Scopes are the scopes the client may request. Any scope may be requested when empty.
+	Scopes []string
+	// ExpiresIn is the lifetime in seconds of the device and user codes issued to the client.
+	ExpiresIn int
+	// PollInterval is the number of seconds the client must wait between polls of the token endpoint.
+	PollInterval int
+	// UserCode is the format of user codes issued to the client.
+	UserCode UserCodeFormat
+	// Provider is the name of the upstream provider the client signs users in with. Empty means the default provider.
+	Provider string
+	// VerificationUriComplete adds the verification uri including the user code to the device authorization response,
+	// for devices that can show it as eg. a QR code.
+	VerificationUriComplete bool
+}
+
+// withDefaults fills in the settings not configured for the client.
+func (c Client) withDefaults(defaults Client) Client {
+	if c.ExpiresIn == 0 {
+		c.ExpiresIn = defaults.ExpiresIn
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = defaults.PollInterval
+	}
+	if c.UserCode.Length == 0 {
+		c.UserCode.Length = defaults.UserCode.Length
+		c.UserCode.GroupSize = defaults.UserCode.GroupSize
+	}
+	if c.UserCode.Charset == "" {
+		c.UserCode.Charset = defaults.UserCode.Charset
+		c.UserCode.Alphabet = defaults.UserCode.Alphabet
+	}
+	return c
+}
+
+// ParseScope splits a space separated scope parameter, see https://datatracker.ietf.org/doc/html/rfc6749#section-3.3
+func ParseScope(scope string) []string {
+	return strings.Fields(scope)
+}
+
+// DisallowedScopes returns the requested scopes the client may not request.
+func (c Client) DisallowedScopes(requested []string) []string {
+	if len(c.Scopes) == 0 {
+		return nil
+	}
+
+	allowed := map[string]bool{}
+	for _, s := range c.Scopes {
+		allowed[s] = true
+	}
+
+	disallowed := []string{}
+	for _, s := range requested {
+		if !allowed[s] {
+			disallowed = append(disallowed, s)
+		}
+	}
+	return disallowed
+}
+
+// ScopesEqual tells if two space separated scope parameters hold the same scopes, in any order.
+func ScopesEqual(a string, b string) bool {
+	as, bs := ParseScope(a), ParseScope(b)
+	if len(as) != len(bs) {
+		return false
+	}
+
+	seen := map[string]int{}
+	for _, s := range as {
+		seen[s]++
+	}
+	for _, s := range bs {
+		if seen[s] == 0 {
+			return false
+		}
+		seen[s]--
+	}
+	return true
+}
+
+// Registry holds the configuration of every known client.
+type Registry struct {
+	defaults Client
+	clients  map[string]Client
+	strict   bool
+}
+
+// NewRegistry creates a registry of the given clients. Clients not in the registry are configured as defaults.
+func NewRegistry(defaults Client, clients ...Client) *Registry {
+	r := &Registry{
+		defaults: defaults,
+		clients:  map[string]Client{},
+	}
+	for _, c := range clients {
+		r.clients[c.Id] = c.withDefaults(defaults)
+	}
+	return r
+}
+
+// NewStrictRegistry creates a registry of the given clients, which rejects clients not in the registry.
+func NewStrictRegistry(defaults Client, clients ...Client) *Registry {
+	r := NewRegistry(defaults, clients...)
+	r.strict = true
+	return r
+}
+
+// All returns every client in the registry.
+func (r *Registry) All() []Client {
+	clients := []Client{}
+	for _, c := range r.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// UserCodeFormats returns every user code format of the clients in the registry and of the defaults, each once.
+func (r *Registry) UserCodeFormats() []UserCodeFormat {
+	formats := []UserCodeFormat{r.defaults.UserCode}
+	seen := map[UserCodeFormat]bool{r.defaults.UserCode: true}
+
+	ids := []string{}
+	for id := range r.clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if format := r.clients[id].UserCode; !seen[format] {
+			formats = append(formats, format)
+			seen[format] = true
+		}
+	}
+	return formats
+}
+
+// Get returns the configuration of a client. Clients not in the registry are configured as defaults, or
+// ErrUnknownClient is returned when the registry is strict.
+func (r *Registry) Get(id string) (Client, error) {
+	if c, ok := r.clients[id]; ok {
+		return c, nil
+	}
+
+	if r.strict {
+		return Client{}, ErrUnknownClient
+	}
+
+	c := r.defaults
+	c.Id = id
+	return c, nil
+}
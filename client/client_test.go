@@ -0,0 +1,192 @@
+package client
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+var testDefaults = Client{
+	ExpiresIn:    300,
+	PollInterval: 5,
+	UserCode:     UserCodeFormat{Charset: CharsetBase20, Length: 8, GroupSize: 4},
+}
+
+func TestParse(t *testing.T) {
+	file := File{}
+	err := yaml.UnmarshalStrict([]byte(`
+clients:
+  - id: tv
+    name: Living room TV
+    scopes: [openid, offline_access]
+    expires_in: 600
+    user_code:
+      length: 9
+      group_size: 3
+  - id: printer
+`), &file)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	r, err := Parse(file, testDefaults)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	tv, err := r.Get("tv")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if tv.Name != "Living room TV" || tv.ExpiresIn != 600 || tv.PollInterval != 5 || tv.UserCode.Length != 9 {
+		t.Fatalf("Get returned %+v", tv)
+	}
+	if disallowed := tv.DisallowedScopes([]string{"openid", "email"}); len(disallowed) != 1 || disallowed[0] != "email" {
+		t.Fatalf("DisallowedScopes returned %v", disallowed)
+	}
+
+	printer, err := r.Get("printer")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if printer.ExpiresIn != 300 || printer.UserCode != testDefaults.UserCode {
+		t.Fatalf("client without settings not given the defaults, got %+v", printer)
+	}
+
+	if _, err := r.Get("unknown"); !errors.Is(err, ErrUnknownClient) {
+		t.Fatalf("Get of unknown client returned %v, want ErrUnknownClient", err)
+	}
+
+	if _, err := Parse(File{Clients: []FileClient{{Id: "tv"}, {Id: "tv"}}}, testDefaults); err == nil {
+		t.Fatalf("Parse accepted a client listed twice")
+	}
+
+	weak := FileClient{Id: "keypad"}
+	weak.UserCode.Charset = CharsetNumeric
+	if _, err := Parse(File{Clients: []FileClient{weak}}, testDefaults); err == nil {
+		t.Fatalf("Parse accepted 8 digit user codes")
+	}
+}
+
+func TestPermissiveRegistry(t *testing.T) {
+	r := NewRegistry(testDefaults)
+
+	c, err := r.Get("anyone")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if c.Id != "anyone" || c.ExpiresIn != 300 {
+		t.Fatalf("Get returned %+v", c)
+	}
+}
+
+func TestUserCodeFormatGroup(t *testing.T) {
+	tests := []struct {
+		format UserCodeFormat
+		code   string
+		want   string
+	}{
+		{UserCodeFormat{Length: 8, GroupSize: 4}, "ABCDEFGH", "ABCD-EFGH"},
+		{UserCodeFormat{Length: 9, GroupSize: 3}, "ABCDEFGHI", "ABC-DEF-GHI"},
+		{UserCodeFormat{Length: 7, GroupSize: 3}, "ABCDEFG", "ABC-DEF-G"},
+		{UserCodeFormat{Length: 6}, "ABCDEF", "ABCDEF"},
+	}
+	for _, test := range tests {
+		if got := test.format.Group(test.code); got != test.want {
+			t.Errorf("Group(%q) with %+v returned %q, want %q", test.code, test.format, got, test.want)
+		}
+	}
+}
+
+func TestUserCodeFormatValidate(t *testing.T) {
+	tests := []struct {
+		format UserCodeFormat
+		valid  bool
+	}{
+		{UserCodeFormat{Charset: CharsetBase20, Length: 8, GroupSize: 4}, true},
+		{UserCodeFormat{Charset: CharsetNumeric, Length: 9, GroupSize: 3}, true},
+		{UserCodeFormat{Charset: CharsetNumeric, Length: 8, GroupSize: 4}, false},
+		{UserCodeFormat{Charset: CharsetBase20, Length: 6}, false},
+		{UserCodeFormat{Charset: CharsetCustom, Alphabet: "abcdefgh23456789", Length: 8}, true},
+		{UserCodeFormat{Charset: CharsetCustom, Alphabet: "abcABC", Length: 20}, false},
+		{UserCodeFormat{Charset: CharsetCustom, Alphabet: "ABC-", Length: 20}, false},
+		{UserCodeFormat{Charset: CharsetCustom, Alphabet: "ABCDEFGHO0", Length: 20}, false},
+		{UserCodeFormat{Charset: CharsetCustom, Alphabet: "ABCDEFGHi1", Length: 20}, false},
+		{UserCodeFormat{Charset: CharsetCustom, Alphabet: "ABCDEFGH01", Length: 20}, true},
+		{UserCodeFormat{Charset: CharsetCustom, Length: 8}, false},
+		{UserCodeFormat{Charset: "base36", Length: 8}, false},
+		{UserCodeFormat{Length: 8}, false},
+	}
+	for _, test := range tests {
+		if err := test.format.Validate(); (err == nil) != test.valid {
+			t.Errorf("Validate of %+v returned %v", test.format, err)
+		}
+	}
+}
+
+func TestUserCodeFormatGenerate(t *testing.T) {
+	format := UserCodeFormat{Charset: CharsetCustom, Alphabet: "ab", Length: 32}
+	code, err := format.Generate()
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if len(code) != 32 || strings.Trim(code, "AB") != "" {
+		t.Fatalf("Generate returned %q, want 32 characters of AB", code)
+	}
+	if NormalizeUserCode(format.Group(code)) != code {
+		t.Fatalf("grouped code %q does not normalize to %q", format.Group(code), code)
+	}
+}
+
+func TestUserCodeFormatNormalize(t *testing.T) {
+	base20 := UserCodeFormat{Charset: CharsetBase20, Length: 8}
+	numeric := UserCodeFormat{Charset: CharsetNumeric, Length: 9}
+	custom := UserCodeFormat{Charset: CharsetCustom, Alphabet: "ABCDEFGHJKMNPQRSTVWXYZ01", Length: 8}
+	letters := UserCodeFormat{Charset: CharsetCustom, Alphabet: "ABCDEFGHIJKMNOPQRSTUVWXYZ", Length: 8}
+
+	tests := []struct {
+		format UserCodeFormat
+		input  string
+		want   string
+	}{
+		{numeric, "123-456-789", "123456789"},
+		{numeric, "I23-4S6-789", "1234S6789"},
+		{numeric, "l0O-OIl-o10", "100011010"},
+		{base20, "bcdf-ghjk", "BCDFGHJK"},
+		{base20, "BCDF-GHJ1", "BCDFGHJL"},
+		{base20, "BCDF-GHJ0", "BCDFGHJ0"},
+		{custom, "AOBI-CL01", "A0B1C101"},
+		{letters, "A0B1-CDEF", "AOBICDEF"},
+	}
+	for _, test := range tests {
+		if got := test.format.Normalize(test.input); got != test.want {
+			t.Errorf("Normalize(%q) with %s returned %q, want %q", test.input, test.format.alphabet(), got, test.want)
+		}
+	}
+}
+
+func TestRegistryUserCodeFormats(t *testing.T) {
+	numeric := UserCodeFormat{Charset: CharsetNumeric, Length: 9, GroupSize: 3}
+	r := NewRegistry(testDefaults, Client{Id: "tv"}, Client{Id: "printer", UserCode: numeric}, Client{Id: "kiosk", UserCode: numeric})
+
+	formats := r.UserCodeFormats()
+	if len(formats) != 2 || formats[0] != testDefaults.UserCode || formats[1] != numeric {
+		t.Fatalf("UserCodeFormats returned %+v, want the defaults and numeric", formats)
+	}
+}
+
+func TestNormalizeUserCode(t *testing.T) {
+	tests := map[string]string{
+		"BCDF-GHJK":      "BCDFGHJK",
+		"bcdf ghjk":      "BCDFGHJK",
+		" 123-456-789":   "123456789",
+		"BCDF\u2013GHJK": "BCDFGHJK",
+	}
+	for input, want := range tests {
+		if got := NormalizeUserCode(input); got != want {
+			t.Errorf("NormalizeUserCode(%q) returned %q, want %q", input, got, want)
+		}
+	}
+}
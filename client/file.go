@@ -0,0 +1,142 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// File is the yaml representation of a client registry.
+//
+//	clients:
+//	  - id: 82a3d148-e386-44b5-9761-ffcfdf58b84c
+//	    name: Living room TV
+//	    scopes: [openid, offline_access]
+//	    expires_in: 600
+//	    poll_interval: 5
+//	    user_code:
+//	      charset: base20
+//	      length: 8
+//	      group_size: 4
+//	    verification_uri_complete: true
+//	  - id: set-top-box
+//	    token_endpoint_auth_method: client_secret_basic
+//	    secret: 8d1f9d6f5d0e4b5f
+//	  - id: kiosk
+//	    token_endpoint_auth_method: private_key_jwt
+//	    jwks_file: /etc/device-flow-proxy/kiosk.jwks.json
+type File struct {
+	Clients []FileClient `yaml:"clients"`
+}
+
+// FileClient is a client in a File. Settings left out are taken from the defaults of the registry.
+type FileClient struct {
+	Id                      string   `yaml:"id"`
+	Name                    string   `yaml:"name"`
+	AuthMethod              string   `yaml:"token_endpoint_auth_method"`
+	Secret                  string   `yaml:"secret"`
+	JwksFile                string   `yaml:"jwks_file"`
+	Scopes                  []string `yaml:"scopes"`
+	ExpiresIn               int      `yaml:"expires_in"`
+	PollInterval            int      `yaml:"poll_interval"`
+	Provider                string   `yaml:"provider"`
+	VerificationUriComplete *bool    `yaml:"verification_uri_complete"`
+	UserCode                struct {
+		Charset   string `yaml:"charset"`
+		Alphabet  string `yaml:"alphabet"`
+		Length    int    `yaml:"length"`
+		GroupSize int    `yaml:"group_size"`
+	} `yaml:"user_code"`
+}
+
+// Parse creates a strict registry of the clients in file.
+func Parse(file File, defaults Client) (*Registry, error) {
+	seen := map[string]bool{}
+	clients := []Client{}
+	for _, fc := range file.Clients {
+		if fc.Id == "" {
+			return nil, fmt.Errorf("client: client without id")
+		}
+		if seen[fc.Id] {
+			return nil, fmt.Errorf("client %s: listed more than once", fc.Id)
+		}
+		seen[fc.Id] = true
+
+		if fc.ExpiresIn < 0 || fc.PollInterval < 0 || fc.UserCode.Length < 0 || fc.UserCode.GroupSize < 0 {
+			return nil, fmt.Errorf("client %s: negative expires_in, poll_interval or user_code", fc.Id)
+		}
+
+		c := Client{
+			Id:                      fc.Id,
+			Name:                    fc.Name,
+			AuthMethod:              fc.AuthMethod,
+			Secret:                  fc.Secret,
+			Scopes:                  fc.Scopes,
+			ExpiresIn:               fc.ExpiresIn,
+			PollInterval:            fc.PollInterval,
+			UserCode:                UserCodeFormat{Charset: fc.UserCode.Charset, Alphabet: fc.UserCode.Alphabet, Length: fc.UserCode.Length, GroupSize: fc.UserCode.GroupSize},
+			Provider:                fc.Provider,
+			VerificationUriComplete: defaults.VerificationUriComplete,
+		}
+		if fc.VerificationUriComplete != nil {
+			c.VerificationUriComplete = *fc.VerificationUriComplete
+		}
+		if err := c.withDefaults(defaults).UserCode.Validate(); err != nil {
+			return nil, fmt.Errorf("client %s: %w", fc.Id, err)
+		}
+
+		if c.AuthMethod == "" {
+			switch {
+			case fc.Secret != "":
+				c.AuthMethod = AuthMethodClientSecretBasic
+			case fc.JwksFile != "":
+				c.AuthMethod = AuthMethodPrivateKeyJwt
+			default:
+				c.AuthMethod = AuthMethodNone
+			}
+		}
+
+		switch c.AuthMethod {
+		case AuthMethodNone:
+			if fc.Secret != "" || fc.JwksFile != "" {
+				return nil, fmt.Errorf("client %s: public clients have no secret or keys", fc.Id)
+			}
+		case AuthMethodClientSecretBasic, AuthMethodClientSecretPost:
+			if fc.Secret == "" {
+				return nil, fmt.Errorf("client %s: %s needs a secret", fc.Id, c.AuthMethod)
+			}
+		case AuthMethodPrivateKeyJwt:
+			if fc.JwksFile == "" {
+				return nil, fmt.Errorf("client %s: %s needs a jwks_file", fc.Id, c.AuthMethod)
+			}
+			data, err := ioutil.ReadFile(fc.JwksFile)
+			if err != nil {
+				return nil, fmt.Errorf("client %s: %w", fc.Id, err)
+			}
+			if c.JWKS, err = parseJWKS(data); err != nil {
+				return nil, fmt.Errorf("client %s: invalid jwks_file: %w", fc.Id, err)
+			}
+		default:
+			return nil, fmt.Errorf("client %s: unsupported token_endpoint_auth_method %s", fc.Id, c.AuthMethod)
+		}
+
+		clients = append(clients, c)
+	}
+
+	return NewStrictRegistry(defaults, clients...), nil
+}
+
+// Load reads a strict registry from a yaml File.
+func Load(path string, defaults Client) (*Registry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := File{}
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	return Parse(file, defaults)
+}
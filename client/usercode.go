@@ -0,0 +1,167 @@
+package client
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// Charsets user codes can be made of, see https://datatracker.ietf.org/doc/html/rfc8628#section-6.1
+const (
+	// CharsetBase20 is upper case consonants without vowels, so codes cannot spell words, and without characters
+	// easily mistaken for digits.
+	CharsetBase20 = "base20"
+	// CharsetNumeric is digits only, for devices with numeric keypads.
+	CharsetNumeric = "numeric"
+	// CharsetCustom is the characters given as the Alphabet of a UserCodeFormat.
+	CharsetCustom = "custom"
+)
+
+// MinUserCodeEntropy is the fewest bits of entropy a user code may have. It lets 9 digits through, which is the
+// weakest code suggested by RFC 8628.
+const MinUserCodeEntropy = 29.0
+
+var charsets = map[string]string{
+	CharsetBase20:  "BCDFGHJKLMNPQRSTVWXZ",
+	CharsetNumeric: "0123456789",
+}
+
+// ambiguous are characters users cannot tell apart when reading a code, so an alphabet may only hold one of each pair.
+var ambiguous = [][2]rune{{'0', 'O'}, {'1', 'I'}}
+
+// lookalikes are characters users type for one another. Those entered but not in the alphabet are folded into the
+// one of the pair that is, see UserCodeFormat.Normalize.
+var lookalikes = append([][2]rune{{'1', 'L'}}, ambiguous...)
+
+// UserCodeGenerator creates the user codes shown to users.
+type UserCodeGenerator interface {
+	// Generate returns a new random user code, normalized as by NormalizeUserCode.
+	Generate() (string, error)
+	// Group formats a user code for display.
+	Group(code string) string
+}
+
+// UserCodeFormat is the characters of a user code, how many there are and how they are grouped with hyphens for display.
+type UserCodeFormat struct {
+	// Charset is CharsetBase20, CharsetNumeric or CharsetCustom.
+	Charset string
+	// Alphabet is the characters of CharsetCustom, which must be letters and digits. Letters are used in upper case.
+	// It may not hold both 0 and O, or both 1 and I.
+	Alphabet  string
+	Length    int
+	GroupSize int
+}
+
+// alphabet returns the characters codes are made of.
+func (f UserCodeFormat) alphabet() string {
+	if f.Charset == CharsetCustom {
+		return strings.ToUpper(f.Alphabet)
+	}
+	return charsets[f.Charset]
+}
+
+// Entropy returns the bits of entropy in a code.
+func (f UserCodeFormat) Entropy() float64 {
+	return float64(f.Length) * math.Log2(float64(len(f.alphabet())))
+}
+
+// Validate checks the format makes codes that can be entered and that are hard enough to guess.
+func (f UserCodeFormat) Validate() error {
+	if f.Charset == CharsetCustom {
+		if f.Alphabet == "" {
+			return fmt.Errorf("user code: the custom charset needs an alphabet")
+		}
+		seen := map[rune]bool{}
+		for _, r := range f.alphabet() {
+			if !isUserCodeCharacter(r) {
+				return fmt.Errorf("user code: the alphabet may only hold letters A-Z and digits, got %q", r)
+			}
+			if seen[r] {
+				return fmt.Errorf("user code: %q is in the alphabet more than once, letters are not case sensitive", r)
+			}
+			seen[r] = true
+		}
+		for _, pair := range ambiguous {
+			if seen[pair[0]] && seen[pair[1]] {
+				return fmt.Errorf("user code: the alphabet may not hold both %q and %q, as they are mistaken for each other", pair[0], pair[1])
+			}
+		}
+	} else if _, ok := charsets[f.Charset]; !ok {
+		return fmt.Errorf("user code: unknown charset %s", f.Charset)
+	}
+
+	if f.Length <= 0 || f.GroupSize < 0 {
+		return fmt.Errorf("user code: must have at least one character and a positive group size")
+	}
+	if entropy := f.Entropy(); entropy < MinUserCodeEntropy {
+		return fmt.Errorf("user code: %d characters of %s have %.1f bits of entropy, at least %.0f are needed", f.Length, f.Charset, entropy, MinUserCodeEntropy)
+	}
+	return nil
+}
+
+// Generate returns a new random code of Length characters from the alphabet.
+func (f UserCodeFormat) Generate() (string, error) {
+	alphabet := f.alphabet()
+	code := make([]byte, f.Length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = alphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// Group inserts a hyphen between every GroupSize characters of code.
+func (f UserCodeFormat) Group(code string) string {
+	if f.GroupSize <= 0 {
+		return code
+	}
+
+	groups := []string{}
+	for len(code) > f.GroupSize {
+		groups = append(groups, code[:f.GroupSize])
+		code = code[f.GroupSize:]
+	}
+	return strings.Join(append(groups, code), "-")
+}
+
+// NormalizeUserCode turns a code as entered by a user into the code as generated. Letters are upper cased and
+// everything else than letters and digits, like hyphens and spaces, is removed, as codes of every charset are made
+// of those alone.
+func NormalizeUserCode(input string) string {
+	return strings.Map(func(r rune) rune {
+		if isUserCodeCharacter(r) {
+			return r
+		}
+		return -1
+	}, strings.ToUpper(input))
+}
+
+// Normalize turns a code as entered by a user into the code as generated, like NormalizeUserCode. Characters not in
+// the alphabet are folded into those in it they are mistaken for, eg. O and I into 0 and 1 for numeric codes, so a
+// typo does not count as a wrong code.
+func (f UserCodeFormat) Normalize(input string) string {
+	alphabet := f.alphabet()
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(alphabet, r) {
+			return r
+		}
+		for _, pair := range lookalikes {
+			if r == pair[0] && strings.ContainsRune(alphabet, pair[1]) {
+				return pair[1]
+			}
+			if r == pair[1] && strings.ContainsRune(alphabet, pair[0]) {
+				return pair[0]
+			}
+		}
+		return r
+	}, NormalizeUserCode(input))
+}
+
+func isUserCodeCharacter(r rune) bool {
+	return (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/wraix/device-flow-proxy/store"
+)
+
+// migrateCmd applies the sql store schema. Unless given as flags the database is taken from the serve configuration.
+type migrateCmd struct {
+	Driver string `long:"store-sql-driver" description:"Database driver for the sql store, defaults to the one configured for serve" choice:"sqlite" choice:"postgres"`
+	Dsn    string `long:"store-sql-dsn" description:"Data source name for the sql store, defaults to the one configured for serve"`
+}
+
+func (m *migrateCmd) Execute(args []string) error {
+	driver := Application.Serve.Store.SQL.Driver
+	if m.Driver != "" {
+		driver = m.Driver
+	}
+	dsn := Application.Serve.Store.SQL.Dsn
+	if m.Dsn != "" {
+		dsn = m.Dsn
+	}
+
+	s, err := openSQLStore(driver, dsn, 0)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := s.Migrate(context.Background()); err != nil {
+		log.Error().Err(err).Msg("Unable to migrate store")
+		return err
+	}
+
+	log.Info().Msg("Store is up to date")
+	return nil
+}
+
+func openSQLStore(driver string, dsn string, purgeInterval time.Duration) (*store.SQLStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s, err := store.NewSQLStore(db, driver, purgeInterval)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
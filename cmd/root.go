@@ -26,8 +26,9 @@ type App struct {
 		Format  string `long:"log-format" description:"Logging format" choice:"json" choice:"plain"`
 	}
 
-	Serve serveCmd `command:"serve" description:"serves endpoints"`
-	Oas   oasCmd   `command:"oas" description:"Retrieve oas document"`
+	Serve   serveCmd   `command:"serve" description:"serves endpoints"`
+	Migrate migrateCmd `command:"migrate" description:"Applies schema migrations for the sql store"`
+	Oas     oasCmd     `command:"oas" description:"Retrieve oas document"`
 	Version versionCmd `command:"version" description:"Prints the build information from the binary"`
 }
 
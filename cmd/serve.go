@@ -2,16 +2,24 @@ package cmd
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
 	"time"
 
-	cache "github.com/patrickmn/go-cache"
+	"github.com/go-redis/redis/v8"
 
 	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/bruteforce"
+	"github.com/wraix/device-flow-proxy/client"
+	"github.com/wraix/device-flow-proxy/endpoint"
+	"github.com/wraix/device-flow-proxy/keyring"
+	"github.com/wraix/device-flow-proxy/provider"
 	"github.com/wraix/device-flow-proxy/router"
+	"github.com/wraix/device-flow-proxy/store"
 	"github.com/wraix/device-flow-proxy/tracing"
 
 	"github.com/charmixer/oas/exporter"
@@ -29,6 +37,8 @@ type serveCmd struct {
 		Port   int    `short:"p" long:"port" description:"Port to serve app on" default:"8080"`
 		Ip     string `short:"i" long:"ip" description:"IP to serve app on" default:"0.0.0.0"`
 		Domain string `short:"d" long:"domain" description:"Domain to access app through" default:"127.0.0.1"`
+		// Named after the X-Forwarded-For family, the last address in the header is used
+		ClientIpHeader string `long:"client-ip-header" description:"Header a reverse proxy in front of the app puts the address of the browser in, eg. X-Forwarded-For. The remote address is used when not set"`
 	}
 	Timeout struct {
 		Write      int `long:"write-timeout" description:"Timeout in seconds for write" default:"10"`
@@ -38,11 +48,69 @@ type serveCmd struct {
 		Grace      int `long:"grace-timeout" description:"Timeout in seconds before shutting down" default:"15"`
 	}
 	DeviceCodeGrant struct {
-		BaseUrl               string `long:"dcg-base-url" description:"The base url for the code flow UI in the proxy" default:"https://localhost:8080"`
-		AuthorizationEndpoint string `long:"dcg-authorization-endpoint" description:"The endpoint for the OAuth2 Provider Authorization endpoint" default:"https://localhost:4444/oauth2/auth"`
-		TokenEndpoint         string `long:"dcg-token-endpoint" description:"The endpoint for the OAuth2 Provider Token endpoint" default:"https://localhost:4444/oauth2/token"`
-		PollIntervalInSeconds int    `long:"dcg-poll-interval" description:"How often in seconds should clients poll to check if user logged in" default:"5"`
-		ExpiresIn             int    `long:"dcg-expires-in" description:"Timeout in seconds for when generated code expires" default:"300"`
+		BaseUrl               string            `long:"dcg-base-url" description:"The base url for the code flow UI in the proxy" default:"https://localhost:8080"`
+		AuthorizationEndpoint string            `long:"dcg-authorization-endpoint" description:"The endpoint for the OAuth2 Provider Authorization endpoint" default:"https://localhost:4444/oauth2/auth"`
+		TokenEndpoint         string            `long:"dcg-token-endpoint" description:"The endpoint for the OAuth2 Provider Token endpoint" default:"https://localhost:4444/oauth2/token"`
+		Issuer                string            `long:"dcg-issuer" description:"Issuer of the OAuth2 Provider, whose endpoints are discovered from its OpenID Connect or OAuth 2.0 authorization server metadata. Replaces the authorization and token endpoint options"`
+		DiscoveryInterval     int               `long:"dcg-discovery-refresh-interval" description:"How often in seconds the endpoints of providers with an issuer are discovered again" default:"3600"`
+		ProvidersFile         string            `long:"dcg-providers-file" description:"Path to a yaml file listing the OAuth2 Providers users can sign in with. Replaces the authorization endpoint, token endpoint and upstream client options"`
+		PollIntervalInSeconds int               `long:"dcg-poll-interval" description:"How often in seconds should clients poll to check if user logged in" default:"5"`
+		MaxSlowDowns          int               `long:"dcg-max-slow-downs" description:"How many times a device may poll faster than the interval before its flow is denied" default:"10"`
+		ExpiresIn             int               `long:"dcg-expires-in" description:"Timeout in seconds for when generated code expires" default:"300"`
+		TombstoneExpiresIn    int               `long:"dcg-tombstone-expires-in" description:"Timeout in seconds for how long expired and denied flows are kept to tell devices what happened" default:"600"`
+		ClientScopes          map[string]string `long:"dcg-client-scopes" description:"Space separated scopes a client is allowed to request, given as client_id:scopes. Clients not listed may request any scope"`
+		ClientsFile           string            `long:"dcg-clients-file" description:"Path to a yaml file listing the clients allowed to use the proxy. Other clients are rejected with invalid_client"`
+		UserCodeCharset       string            `long:"dcg-user-code-charset" description:"Characters user codes are made of, upper case consonants, digits or the characters given by --dcg-user-code-alphabet" choice:"base20" choice:"numeric" choice:"custom" default:"base20"`
+		UserCodeAlphabet      string            `long:"dcg-user-code-alphabet" description:"Letters and digits user codes are made of with the custom charset"`
+		UserCodeLength        int               `long:"dcg-user-code-length" description:"Number of characters in user codes" default:"8"`
+		UserCodeGroupSize     int               `long:"dcg-user-code-group-size" description:"Number of characters between hyphens in user codes shown to users, 0 for no hyphens" default:"4"`
+
+		Upstream struct {
+			ClientId     string `long:"dcg-upstream-client-id" description:"Client id the proxy signs users in with at the OAuth2 Provider for every device client. Device clients sign in as themselves when not set"`
+			ClientSecret string `long:"dcg-upstream-client-secret" description:"Client secret of the upstream client"`
+			AuthMethod   string `long:"dcg-upstream-client-auth-method" description:"How the proxy authenticates the upstream client at the OAuth2 Provider token endpoint" choice:"client_secret_basic" choice:"client_secret_post" default:"client_secret_basic"`
+		}
+
+		ProviderTLS struct {
+			InsecureSkipVerify bool   `long:"dcg-tls-insecure-skip-verify" description:"Accept any certificate presented by the OAuth2 Provider"`
+			CAFile             string `long:"dcg-tls-ca-file" description:"Pem file with the certificates the OAuth2 Provider certificate must be signed by, instead of the system pool"`
+			CertFile           string `long:"dcg-tls-cert-file" description:"Pem encoded client certificate presented to the OAuth2 Provider"`
+			KeyFile            string `long:"dcg-tls-key-file" description:"Pem encoded key of the client certificate presented to the OAuth2 Provider"`
+		}
+
+		UserCodeAttempts struct {
+			Free       int `long:"dcg-user-code-free-attempts" description:"How many wrong user codes a browser may enter before being locked out" default:"5"`
+			Lockout    int `long:"dcg-user-code-lockout" description:"Seconds the first lockout after too many wrong user codes lasts, doubling with every further wrong code" default:"30"`
+			MaxLockout int `long:"dcg-user-code-max-lockout" description:"Maximum seconds a browser is locked out from entering user codes" default:"3600"`
+			Window     int `long:"dcg-user-code-attempts-window" description:"Seconds wrong user codes are counted after the last one" default:"86400"`
+		}
+
+		VerificationUriComplete       bool            `long:"dcg-verification-uri-complete" description:"Return verification_uri_complete including the user code to devices, eg. for showing a QR code"`
+		ClientVerificationUriComplete map[string]bool `long:"dcg-client-verification-uri-complete" description:"Override returning verification_uri_complete for a client, given as client_id:true or client_id:false"`
+	}
+	Store struct {
+		Backend string `long:"store-backend" description:"Storage backend for pending and completed device flows" choice:"memory" choice:"redis" choice:"bolt" choice:"sql" default:"memory"`
+		Redis   struct {
+			Addr     string `long:"store-redis-addr" description:"Address of the redis server" default:"localhost:6379"`
+			Username string `long:"store-redis-username" description:"Username for the redis server"`
+			Password string `long:"store-redis-password" description:"Password for the redis server"`
+			DB       int    `long:"store-redis-db" description:"Redis database to use" default:"0"`
+			Prefix   string `long:"store-redis-prefix" description:"Prefix for all keys written to redis" default:"device-flow-proxy:"`
+		}
+		Bolt struct {
+			Path string `long:"store-bolt-path" description:"Path to the database file for the embedded bolt store" default:"device-flow-proxy.db"`
+		}
+		SQL struct {
+			Driver         string `long:"store-sql-driver" description:"Database driver for the sql store" choice:"sqlite" choice:"postgres" default:"sqlite"`
+			Dsn            string `long:"store-sql-dsn" description:"Data source name for the sql store, eg. a file path for sqlite or a connection url for postgres" default:"device-flow-proxy.sqlite"`
+			SkipMigrations bool   `long:"store-sql-skip-migrations" description:"Do not apply schema migrations on startup, use the migrate command instead"`
+		}
+		HashKey    string `long:"store-hash-key" description:"Base64 encoded secret of at least 32 bytes used to hash device codes, user codes and states before they are used as keys in the store"`
+		Encryption struct {
+			Keyring    string            `long:"store-encryption-keyring" description:"Path to a yaml keyring with the keys used to encrypt PKCE verifiers and token responses at rest"`
+			PrimaryKey string            `long:"store-encryption-primary-key" description:"Id of the key new values are encrypted with, when keys are given with --store-encryption-key"`
+			Keys       map[string]string `long:"store-encryption-key" description:"Base64 encoded 32 byte key used to encrypt values at rest, given as id:key. Keep retired keys to decrypt older values"`
+		}
 	}
 	TLS struct {
 		Cert struct {
@@ -87,6 +155,208 @@ func (cmd *serveCmd) initTracing() func() {
 	return nil
 }
 
+func (cmd *serveCmd) initStore() (store.FlowStore, error) {
+	switch cmd.Store.Backend {
+	case "redis":
+		client := redis.NewClient(&redis.Options{
+			Addr:     cmd.Store.Redis.Addr,
+			Username: cmd.Store.Redis.Username,
+			Password: cmd.Store.Redis.Password,
+			DB:       cmd.Store.Redis.DB,
+		})
+		if err := client.Ping(context.Background()).Err(); err != nil {
+			return nil, err
+		}
+
+		log.Info().Msgf("Storing device flows in redis @ %s", cmd.Store.Redis.Addr)
+		return store.NewRedisStore(client, cmd.Store.Redis.Prefix), nil
+	case "bolt":
+		log.Info().Msgf("Storing device flows in bolt database @ %s", cmd.Store.Bolt.Path)
+		return store.NewBoltStore(cmd.Store.Bolt.Path, time.Minute*time.Duration(app.Env.CachePurgeExpired))
+	case "sql":
+		s, err := openSQLStore(cmd.Store.SQL.Driver, cmd.Store.SQL.Dsn, time.Minute*time.Duration(app.Env.CachePurgeExpired))
+		if err != nil {
+			return nil, err
+		}
+
+		if !cmd.Store.SQL.SkipMigrations {
+			if err := s.Migrate(context.Background()); err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+
+		log.Info().Msgf("Storing device flows in %s database", cmd.Store.SQL.Driver)
+		return s, nil
+	default:
+		// Use simple in memory cache - WARNING: use persistent storage like redis in production!
+		// Create a cache with a default expiration time of 5 minutes, and which purges expired items every 10 minutes
+		log.Warn().Msg("Storing device flows in memory, they will be lost on restart and not shared between replicas")
+		return store.NewMemoryStore(time.Second*time.Duration(app.Env.CacheDefaultExpiration), time.Minute*time.Duration(app.Env.CachePurgeExpired)), nil
+	}
+}
+
+func (cmd *serveCmd) initKeyring() (*keyring.Keyring, error) {
+	if cmd.Store.Encryption.Keyring != "" {
+		log.Info().Msgf("Loading keyring from %s", cmd.Store.Encryption.Keyring)
+		return keyring.Load(cmd.Store.Encryption.Keyring)
+	}
+
+	if len(cmd.Store.Encryption.Keys) > 0 {
+		return keyring.Parse(keyring.File{
+			Primary: cmd.Store.Encryption.PrimaryKey,
+			Keys:    cmd.Store.Encryption.Keys,
+		})
+	}
+
+	// A random key only lives as long as the process, which is as long as flows in memory do
+	if cmd.Store.Backend != "memory" {
+		return nil, fmt.Errorf("the %s store needs encryption keys shared by every replica, give --store-encryption-keyring or --store-encryption-key", cmd.Store.Backend)
+	}
+
+	log.Warn().Msg("No encryption keys configured, using a random key")
+	return keyring.Ephemeral()
+}
+
+func (cmd *serveCmd) initHashKey() ([]byte, error) {
+	if cmd.Store.HashKey != "" {
+		key, err := base64.StdEncoding.DecodeString(cmd.Store.HashKey)
+		if err != nil {
+			return nil, fmt.Errorf("the hash key is not base64 encoded: %w", err)
+		}
+		// A short key can be guessed, after which the codes hashed with it can be found by hashing every possible code
+		if len(key) < store.MinHashKeySize {
+			return nil, fmt.Errorf("the hash key is %d bytes, at least %d are needed", len(key), store.MinHashKeySize)
+		}
+		return key, nil
+	}
+
+	// Codes hashed with a random key cannot be found after a restart or by other replicas
+	if cmd.Store.Backend != "memory" {
+		return nil, fmt.Errorf("the %s store needs a hash key shared by every replica, give --store-hash-key", cmd.Store.Backend)
+	}
+
+	log.Warn().Msg("No hash key configured, using a random key")
+	return endpoint.GenerateRandomBytes(store.MinHashKeySize)
+}
+
+func (cmd *serveCmd) initClients() (*client.Registry, error) {
+	defaults := client.Client{
+		ExpiresIn:    cmd.DeviceCodeGrant.ExpiresIn,
+		PollInterval: cmd.DeviceCodeGrant.PollIntervalInSeconds,
+		UserCode: client.UserCodeFormat{
+			Charset:   cmd.DeviceCodeGrant.UserCodeCharset,
+			Alphabet:  cmd.DeviceCodeGrant.UserCodeAlphabet,
+			Length:    cmd.DeviceCodeGrant.UserCodeLength,
+			GroupSize: cmd.DeviceCodeGrant.UserCodeGroupSize,
+		},
+		VerificationUriComplete: cmd.DeviceCodeGrant.VerificationUriComplete,
+	}
+
+	if err := defaults.UserCode.Validate(); err != nil {
+		return nil, err
+	}
+
+	if cmd.DeviceCodeGrant.ClientsFile != "" {
+		if len(cmd.DeviceCodeGrant.ClientScopes) > 0 || len(cmd.DeviceCodeGrant.ClientVerificationUriComplete) > 0 {
+			return nil, fmt.Errorf("clients must be configured in the clients file when one is given")
+		}
+
+		log.Info().Msgf("Only allowing clients listed in %s", cmd.DeviceCodeGrant.ClientsFile)
+		return client.Load(cmd.DeviceCodeGrant.ClientsFile, defaults)
+	}
+
+	clients := map[string]client.Client{}
+	get := func(id string) client.Client {
+		if c, ok := clients[id]; ok {
+			return c
+		}
+		c := defaults
+		c.Id = id
+		return c
+	}
+
+	for id, scopes := range cmd.DeviceCodeGrant.ClientScopes {
+		c := get(id)
+		c.Scopes = client.ParseScope(scopes)
+		clients[id] = c
+	}
+	for id, enabled := range cmd.DeviceCodeGrant.ClientVerificationUriComplete {
+		c := get(id)
+		c.VerificationUriComplete = enabled
+		clients[id] = c
+	}
+
+	registry := []client.Client{}
+	for _, c := range clients {
+		registry = append(registry, c)
+	}
+	return client.NewRegistry(defaults, registry...), nil
+}
+
+func (cmd *serveCmd) initProviders() (*provider.Registry, error) {
+	upstream := cmd.DeviceCodeGrant.Upstream
+
+	if cmd.DeviceCodeGrant.ProvidersFile != "" {
+		if upstream.ClientId != "" {
+			return nil, fmt.Errorf("the upstream client must be configured in the providers file when one is given")
+		}
+
+		log.Info().Msgf("Signing users in with the providers in %s", cmd.DeviceCodeGrant.ProvidersFile)
+		return provider.Load(cmd.DeviceCodeGrant.ProvidersFile)
+	}
+
+	settings := provider.TLS{
+		InsecureSkipVerify: cmd.DeviceCodeGrant.ProviderTLS.InsecureSkipVerify,
+		CAFile:             cmd.DeviceCodeGrant.ProviderTLS.CAFile,
+		CertFile:           cmd.DeviceCodeGrant.ProviderTLS.CertFile,
+		KeyFile:            cmd.DeviceCodeGrant.ProviderTLS.KeyFile,
+	}
+	// Discovery decides where codes, verifiers and secrets are sent, so the issuer is always verified. Endpoints given
+	// by hand default to a local hydra with a self-signed certificate, which is accepted unless tls is configured.
+	if cmd.DeviceCodeGrant.Issuer != "" && settings.InsecureSkipVerify {
+		return nil, fmt.Errorf("the certificate of the issuer must be verified, give --dcg-tls-ca-file instead of --dcg-tls-insecure-skip-verify")
+	}
+	if cmd.DeviceCodeGrant.Issuer == "" && settings == (provider.TLS{}) {
+		log.Warn().Msg("Not verifying the certificate of the OAuth2 Provider, give --dcg-tls-ca-file to verify it")
+		settings.InsecureSkipVerify = true
+	}
+	config, err := settings.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &provider.Provider{
+		Name:       "default",
+		HTTPClient: provider.NewHTTPClient(config),
+	}
+
+	if cmd.DeviceCodeGrant.Issuer != "" {
+		p.Issuer = cmd.DeviceCodeGrant.Issuer
+		log.Info().Msgf("Discovering provider endpoints of issuer %s", p.Issuer)
+	} else {
+		p.Endpoints = provider.Endpoints{
+			Authorization: cmd.DeviceCodeGrant.AuthorizationEndpoint,
+			Token:         cmd.DeviceCodeGrant.TokenEndpoint,
+		}
+	}
+
+	if upstream.ClientId != "" {
+		if upstream.ClientSecret == "" {
+			return nil, fmt.Errorf("the upstream client needs a secret")
+		}
+
+		p.Client = client.Client{
+			Id:         upstream.ClientId,
+			AuthMethod: upstream.AuthMethod,
+			Secret:     upstream.ClientSecret,
+		}
+		log.Info().Msgf("Signing users in as upstream client %s for all device clients", p.Client.Id)
+	}
+
+	return provider.NewRegistry(p.Name, p)
+}
+
 func (cmd *serveCmd) Execute(args []string) error {
 	app.Env.Ip = cmd.Public.Ip
 	app.Env.Port = cmd.Public.Port
@@ -106,15 +376,63 @@ func (cmd *serveCmd) Execute(args []string) error {
 	)
 	app.Env.OpenAPI = oasModel
 
-	// Use simple in memory cache - WARNING: use persistent storage cache like redis in production!
-	// Create a cache with a default expiration time of 5 minutes, and which purges expired items every 10 minutes
 	app.Env.BaseUrl = cmd.DeviceCodeGrant.BaseUrl
-	app.Env.AuthorizationEndpoint = cmd.DeviceCodeGrant.AuthorizationEndpoint
-	app.Env.TokenEndpoint = cmd.DeviceCodeGrant.TokenEndpoint
 	app.Env.PollIntervalInSeconds = cmd.DeviceCodeGrant.PollIntervalInSeconds // 5
+	app.Env.MaxSlowDowns = cmd.DeviceCodeGrant.MaxSlowDowns
 	app.Env.CacheDefaultExpiration = cmd.DeviceCodeGrant.ExpiresIn
+	app.Env.TombstoneExpiration = cmd.DeviceCodeGrant.TombstoneExpiresIn
 	app.Env.CachePurgeExpired = 10
-	app.Env.Cache = cache.New(time.Second*time.Duration(app.Env.CacheDefaultExpiration), time.Minute*time.Duration(app.Env.CachePurgeExpired))
+
+	clients, err := cmd.initClients()
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to setup clients")
+		return err
+	}
+	app.Env.Clients = clients
+
+	providers, err := cmd.initProviders()
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to setup providers")
+		return err
+	}
+	for _, c := range clients.All() {
+		if _, err := providers.Get(c.Provider); err != nil {
+			log.Error().Err(err).Str("client_id", c.Id).Str("provider", c.Provider).Msg("Client signs in with an unknown provider")
+			return err
+		}
+	}
+	app.Env.Providers = providers
+
+	stopDiscovery := providers.StartDiscovery(time.Duration(cmd.DeviceCodeGrant.DiscoveryInterval) * time.Second)
+	defer stopDiscovery()
+
+	flowStore, err := cmd.initStore()
+	if err != nil {
+		log.Error().Err(err).Str("backend", cmd.Store.Backend).Msg("Unable to setup store")
+		return err
+	}
+
+	keys, err := cmd.initKeyring()
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to setup keyring")
+		return err
+	}
+
+	hashKey, err := cmd.initHashKey()
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to setup hash key")
+		return err
+	}
+	app.Env.Store = store.NewHashedStore(store.NewEncryptedStore(flowStore, keys), hashKey)
+
+	attempts := cmd.DeviceCodeGrant.UserCodeAttempts
+	app.Env.BruteForce = bruteforce.NewGuard(app.Env.Store, bruteforce.Policy{
+		FreeAttempts: attempts.Free,
+		Lockout:      time.Second * time.Duration(attempts.Lockout),
+		MaxLockout:   time.Second * time.Duration(attempts.MaxLockout),
+		Window:       time.Second * time.Duration(attempts.Window),
+	})
+	app.Env.ClientIpHeader = cmd.Public.ClientIpHeader
 
 	// 3x. server handler er (router resolve, chain, router(chain resolved)
 	//https://github.com/julienschmidt/httprouter
@@ -150,6 +468,12 @@ func (cmd *serveCmd) Execute(args []string) error {
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
 	srv.Shutdown(ctx)
+
+	if closer, ok := app.Env.Store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Error().Err(err).Msg("Unable to close store")
+		}
+	}
 	// Optionally, you could run srv.Shutdown in a goroutine and block on
 	// <-ctx.Done() if your application should wait for other services
 	// to finalize based on context cancellation.
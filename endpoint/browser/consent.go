@@ -0,0 +1,179 @@
+package browser
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/endpoint"
+	"github.com/wraix/device-flow-proxy/endpoint/problem"
+	"github.com/wraix/device-flow-proxy/store"
+
+	"github.com/charmixer/oas/api"
+
+	"go.opentelemetry.io/otel"
+
+	"github.com/rs/zerolog/log"
+)
+
+type PostConsentRequest struct {
+	State  string `form:"state" validate:"required"`
+	Action string `form:"action" validate:"required,oneof=approve deny"`
+}
+
+type PostConsentEndpoint struct {
+	endpoint.Endpoint
+}
+
+// ConsentPageData tells the user what asks for access, before approving or denying it.
+type ConsentPageData struct {
+	PageTitle  string
+	FormAction string
+	State      string
+	// ClientName is the name of the client, or its id when it has no name
+	ClientName string
+	Scopes     []string
+	// DeviceName and DeviceUserAgent are told by the device, so they are shown as such
+	DeviceName      string
+	DeviceUserAgent string
+	RequestedAt     string
+}
+
+func (ep PostConsentEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tr := otel.Tracer("request")
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s execution", r.URL.Path))
+	defer span.End()
+
+	request := PostConsentRequest{}
+	if err := endpoint.WithFormRequestParser(ctx, r, &request); err != nil {
+		problem.MustWrite(w, err)
+		return
+	}
+
+	if err := endpoint.WithRequestValidation(ctx, &request); err != nil {
+		problem.MustWrite(w, err)
+		return
+	}
+
+	// The state was bound to the flow when the code was entered, and is only known to the browser that entered it
+	flow, err := app.Env.Store.GetByState(ctx, request.State)
+	if errors.Is(err, store.ErrNotFound) {
+		prob := problem.New(http.StatusBadRequest).WithDetail("The state parameter is invalid")
+		problem.MustWrite(w, prob)
+		return
+	}
+	if err != nil {
+		prob := problem.New(http.StatusInternalServerError).WithErr(err)
+		problem.MustWrite(w, prob)
+		return
+	}
+	if flow.Status != store.StatusPending || flow.Expired(time.Now()) {
+		prob := problem.New(http.StatusBadRequest).WithDetail("Code expired or already used, start over on the device")
+		problem.MustWrite(w, prob)
+		return
+	}
+
+	if request.Action == "deny" {
+		log.Info().Str("client_id", flow.ClientId).Str("provider", flow.Provider).Msg("User denied device")
+		denyFlow(ctx, flow.DeviceCode, "The user denied access")
+
+		tmpl := page("error.html")
+		data := ErrorPage{
+			PageTitle:        "Access Denied",
+			Error:            "Access Denied",
+			ErrorDescription: "The device was not given access. You can close this page.",
+		}
+		tmpl.Execute(w, data)
+		return
+	}
+
+	pkceVerifier := CodeVerifier{
+		Value: flow.PkceVerifier,
+	}
+	pkceChallenge := pkceVerifier.CodeChallengeS256() // base64_urlencode(hash('sha256', $cache->pkce_verifier, true))
+
+	p, upstream, err := flowProvider(flow)
+	if err != nil {
+		prob := problem.New(http.StatusInternalServerError).WithErr(err)
+		problem.MustWrite(w, prob)
+		return
+	}
+
+	endpoints := p.Current()
+	if endpoints.Authorization == "" {
+		prob := problem.New(http.StatusServiceUnavailable).WithDetail("The endpoints of the provider are not discovered yet, try again later")
+		problem.MustWrite(w, prob)
+		return
+	}
+
+	base, err := url.Parse(endpoints.Authorization)
+	if err != nil {
+		prob := problem.New(http.StatusInternalServerError).WithErr(err)
+		problem.MustWrite(w, prob)
+		return
+	}
+
+	// Query params
+	q := url.Values{}
+
+	q.Add("response_type", "code")
+	q.Add("client_id", upstream.Id)
+	q.Add("redirect_uri", app.Env.BaseUrl+p.RedirectPath())
+	q.Add("state", request.State)
+	q.Add("code_challenge", pkceChallenge)
+	q.Add("code_challenge_method", "S256")
+
+	if flow.Scope != "" {
+		q.Add("scope", flow.Scope)
+	}
+
+	base.RawQuery = q.Encode()
+
+	authUrl := base.String()
+
+	// Only the browser approving the device may finish the flow, a state leaked to another browser is of no use
+	session := approval(r)
+	if session == "" {
+		prob := problem.New(http.StatusBadRequest).WithDetail("The browser session is missing, enter the code again")
+		problem.MustWrite(w, prob)
+		return
+	}
+	err = app.Env.Store.Approve(ctx, flow.DeviceCode, session)
+	if errors.Is(err, store.ErrNotFound) {
+		prob := problem.New(http.StatusBadRequest).WithDetail("Code expired or already used, start over on the device")
+		problem.MustWrite(w, prob)
+		return
+	}
+	if err != nil {
+		prob := problem.New(http.StatusInternalServerError).WithErr(err)
+		problem.MustWrite(w, prob)
+		return
+	}
+
+	log.Info().Str("client_id", flow.ClientId).Str("provider", p.Name).Str("upstream_client_id", upstream.Id).Msg("Redirecting user to sign in")
+
+	http.Redirect(w, r, authUrl, http.StatusSeeOther)
+}
+
+func NewPostConsentEndpoint() endpoint.EndpointHandler {
+	ep := PostConsentEndpoint{}
+
+	ep.Setup(
+		endpoint.WithSpecification(api.Path{
+			Summary:     "Approve or deny the device",
+			Description: ``,
+			Tags:        OPENAPI_TAGS,
+
+			Request: api.Request{
+				Description: ``,
+				Schema:      PostConsentRequest{},
+			},
+		}),
+	)
+
+	return ep
+}
@@ -0,0 +1,169 @@
+package browser
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/client"
+	"github.com/wraix/device-flow-proxy/endpoint/device"
+	"github.com/wraix/device-flow-proxy/store"
+)
+
+// setupConsentEnv configures a store and the client tv. The environment is restored when the test ends.
+func setupConsentEnv(t *testing.T) *store.MemoryStore {
+	t.Helper()
+
+	env := app.Env
+	t.Cleanup(func() { app.Env = env })
+
+	s := store.NewMemoryStore(time.Minute, time.Minute)
+	app.Env.BaseUrl = "http://localhost:8080"
+	app.Env.Store = s
+	app.Env.Clients = client.NewStrictRegistry(client.Client{}, client.Client{Id: "tv"})
+	return s
+}
+
+// createConsentFlow creates a pending flow of the client tv expiring at the given time, and returns the state bound to it.
+func createConsentFlow(t *testing.T, s *store.MemoryStore, deviceCode string, userCode string, expiresAt time.Time) string {
+	t.Helper()
+
+	ctx := context.Background()
+	flow := store.Flow{
+		DeviceCode: deviceCode,
+		UserCode:   userCode,
+		ClientId:   "tv",
+		IssuedAt:   expiresAt.Add(-time.Minute),
+		ExpiresAt:  expiresAt,
+		Interval:   5,
+	}
+	if err := s.CreatePendingFlow(ctx, flow, time.Minute); err != nil {
+		t.Fatalf("CreatePendingFlow: %v", err)
+	}
+	state := "state-" + deviceCode
+	if err := s.BindState(ctx, state, deviceCode, time.Minute); err != nil {
+		t.Fatalf("BindState: %v", err)
+	}
+	return state
+}
+
+// postConsent posts action on the consent page, from the browser with the given session unless it is empty.
+func postConsent(state string, action string, session string) *httptest.ResponseRecorder {
+	form := url.Values{"state": {state}, "action": {action}}
+	r := httptest.NewRequest(http.MethodPost, "/consent", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if session != "" {
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: session})
+	}
+	w := httptest.NewRecorder()
+	NewPostConsentEndpoint().ServeHTTP(w, r)
+	return w
+}
+
+func TestConsentDeny(t *testing.T) {
+	s := setupConsentEnv(t)
+	state := createConsentFlow(t, s, "device-code", "BDWPHQJT", time.Now().Add(time.Minute))
+
+	if w := postConsent(state, "deny", "session"); w.Code != http.StatusOK {
+		t.Fatalf("Denying returned %d: %s", w.Code, w.Body.String())
+	}
+
+	// The device polling for the token is told the user denied it
+	form := url.Values{"grant_type": {device.GrantTypeDeviceCode}, "client_id": {"tv"}, "device_code": {"device-code"}}
+	r := httptest.NewRequest(http.MethodPost, "/device/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	device.NewPostTokenEndpoint().ServeHTTP(w, r)
+
+	e := device.ErrorResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatalf("Unable to decode error response %q: %v", w.Body.String(), err)
+	}
+	if w.Code != http.StatusBadRequest || e.Error != "access_denied" {
+		t.Fatalf("Token of denied flow returned %d %q, want 400 access_denied", w.Code, e.Error)
+	}
+	if e.ErrorDescription != "The user denied access" {
+		t.Fatalf("Token of denied flow returned the description %q", e.ErrorDescription)
+	}
+}
+
+func TestConsentRefusesFlowNotPending(t *testing.T) {
+	s := setupConsentEnv(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	denied := createConsentFlow(t, s, "denied", "BBBBBBBB", now.Add(time.Minute))
+	if err := s.Deny(ctx, "denied", "Denied before"); err != nil {
+		t.Fatalf("Deny: %v", err)
+	}
+	complete := createConsentFlow(t, s, "complete", "CCCCCCCC", now.Add(time.Minute))
+	if err := s.Complete(ctx, "complete", `{"access_token":"token"}`, time.Minute); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	expired := createConsentFlow(t, s, "expired", "DDDDDDDD", now.Add(-time.Second))
+
+	tests := map[string]store.Status{
+		denied:   store.StatusDenied,
+		complete: store.StatusComplete,
+		expired:  store.StatusPending,
+	}
+	for state, status := range tests {
+		for _, action := range []string{"approve", "deny"} {
+			if w := postConsent(state, action, "session"); w.Code != http.StatusBadRequest {
+				t.Errorf("Consenting to %s with %s returned %d, want 400", state, action, w.Code)
+			}
+		}
+
+		// The flow is left as it was
+		flow, err := s.GetByState(ctx, state)
+		if err != nil {
+			t.Fatalf("GetByState(%s): %v", state, err)
+		}
+		if flow.Status != status {
+			t.Errorf("Flow of %s is %v after consenting, want %v", state, flow.Status, status)
+		}
+	}
+}
+
+func TestConsentApprove(t *testing.T) {
+	s := setupRedirectEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Provider called when approving")
+	})
+	ctx := context.Background()
+	state := createConsentFlow(t, s, "device-code", "BDWPHQJT", time.Now().Add(time.Minute))
+
+	// A browser without a session never entered the code, so it cannot approve
+	if w := postConsent(state, "approve", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("Approving without session returned %d, want 400", w.Code)
+	}
+	if flow, err := s.GetByState(ctx, state); err != nil || flow.ApprovedBy != "" {
+		t.Fatalf("Flow after approving without session is %+v, %v", flow, err)
+	}
+
+	w := postConsent(state, "approve", "session")
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Approving returned %d: %s", w.Code, w.Body.String())
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Unable to parse Location: %v", err)
+	}
+	if location.Path != "/oauth2/auth" || location.Query().Get("state") != state || location.Query().Get("code_challenge_method") != "S256" {
+		t.Fatalf("Approving redirected to %s, want the authorization endpoint", location)
+	}
+
+	// The flow is approved by the session, still waiting for the user to sign in
+	flow, err := s.GetByState(ctx, state)
+	if err != nil {
+		t.Fatalf("GetByState: %v", err)
+	}
+	if flow.Status != store.StatusPending || flow.ApprovedBy == "" || flow.ApprovedBy == "session" {
+		t.Fatalf("Flow after approving is %v approved by %q, want pending approved by the hash of the session", flow.Status, flow.ApprovedBy)
+	}
+}
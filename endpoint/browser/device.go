@@ -5,6 +5,7 @@ import (
 	"html/template"
 	"net/http"
 
+	"github.com/wraix/device-flow-proxy/app"
 	"github.com/wraix/device-flow-proxy/endpoint"
 	"github.com/wraix/device-flow-proxy/endpoint/problem"
 
@@ -25,6 +26,8 @@ type DevicePageData struct {
 	Code       string
 	FormAction string
 	PageTitle  string
+	// Challenge is shown in the form when the browser must prove to be human before entering the code
+	Challenge template.HTML
 }
 
 func (ep GetDeviceEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -44,7 +47,13 @@ func (ep GetDeviceEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tmpl := template.Must(template.ParseFiles("./endpoint/browser/device.html"))
+	keys, err := attemptKeys(w, r)
+	if err != nil {
+		problem.MustWrite(w, problem.New(http.StatusInternalServerError).WithErr(err))
+		return
+	}
+
+	tmpl := page("device.html")
 
 	data := DevicePageData{
 		Code:       request.Code,
@@ -52,6 +61,15 @@ func (ep GetDeviceEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		PageTitle:  "Enter Device Code",
 	}
 
+	required, err := app.Env.BruteForce.ChallengeRequired(ctx, keys)
+	if err != nil {
+		problem.MustWrite(w, problem.New(http.StatusInternalServerError).WithErr(err))
+		return
+	}
+	if required {
+		data.Challenge = app.Env.BruteForce.Challenge.Form()
+	}
+
 	tmpl.Execute(w, data)
 }
 
@@ -1,11 +1,109 @@
 package browser
 
 import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+
 	"github.com/charmixer/oas/api"
+
+	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/client"
+	"github.com/wraix/device-flow-proxy/endpoint"
+	"github.com/wraix/device-flow-proxy/provider"
+	"github.com/wraix/device-flow-proxy/store"
 )
 
+// sessionCookie identifies a browser, to count the wrong user codes entered in it and to tie the approval of a device
+// to it.
+const sessionCookie = "device_flow_session"
+
+// pages are the html pages shown to the user, built into the binary so it runs from any directory.
+//
+//go:embed *.html
+var pages embed.FS
+
 var (
 	OPENAPI_TAGS = []api.Tag{
 		{Name: "Browser", Description: "Human UI endpoints"},
 	}
 )
+
+// page parses the named html page.
+func page(name string) *template.Template {
+	return template.Must(template.ParseFS(pages, name))
+}
+
+// flowProvider returns the provider the user signs in with for a flow, and the client to sign in as. This is the device
+// client itself, unless the proxy holds credentials of its own client at the provider.
+func flowProvider(flow *store.Flow) (*provider.Provider, client.Client, error) {
+	p, err := app.Env.Providers.Get(flow.Provider)
+	if err != nil {
+		return nil, client.Client{}, err
+	}
+
+	device, err := app.Env.Clients.Get(flow.ClientId)
+	if err != nil {
+		return nil, client.Client{}, err
+	}
+
+	return p, p.UpstreamClient(device), nil
+}
+
+// attemptKeys identify who enters a user code, by the address and session of the browser. A session is started in
+// browsers without one.
+func attemptKeys(w http.ResponseWriter, r *http.Request) ([]string, error) {
+	session := ""
+	if cookie, err := r.Cookie(sessionCookie); err == nil && cookie.Value != "" {
+		session = cookie.Value
+	} else {
+		id, err := endpoint.GenerateRandomBytes(16)
+		if err != nil {
+			return nil, err
+		}
+		session = hex.EncodeToString(id)
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    session,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(app.Env.BaseUrl, "https://"),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	return []string{"ip:" + clientIp(r), "session:" + session}, nil
+}
+
+// approval identifies the session of the browser approving a device, by a hash so the store never holds the session
+// itself. It is empty when the browser has no session.
+func approval(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(cookie.Value))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientIp is the address of the browser, as seen by the reverse proxy in front of the proxy when one is configured.
+func clientIp(r *http.Request) string {
+	if app.Env.ClientIpHeader != "" {
+		// Every proxy appends the address it sees to X-Forwarded-For, only the last one was added by a trusted proxy
+		forwarded := strings.Split(r.Header.Get(app.Env.ClientIpHeader), ",")
+		if ip := strings.TrimSpace(forwarded[len(forwarded)-1]); ip != "" {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -1,31 +1,36 @@
 package browser
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"time"
 
 	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/client"
 	"github.com/wraix/device-flow-proxy/endpoint"
 	"github.com/wraix/device-flow-proxy/endpoint/problem"
+	"github.com/wraix/device-flow-proxy/provider"
+	"github.com/wraix/device-flow-proxy/store"
 
 	"github.com/charmixer/oas/api"
 
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
-	"go.opentelemetry.io/contrib/propagators/jaeger"
+	"github.com/julienschmidt/httprouter"
+
 	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/rs/zerolog/log"
 )
 
 type GetRedirectRequest struct {
-	Code  string `query:"code" validate:"required"`
-	State string `query:"state" validate:"required"`
+	Code             string `query:"code" validate:"required_without=Error"`
+	State            string `query:"state" validate:"required"`
+	Error            string `query:"error"`
+	ErrorDescription string `query:"error_description"`
 }
 
 type GetRedirectEndpoint struct {
@@ -33,14 +38,18 @@ type GetRedirectEndpoint struct {
 }
 
 type Token struct {
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int    `json:"expires_in"`
-	Scope       string `json:"scope"`
-	TokenType   string `json:"token_type"`
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Scope            string `json:"scope"`
+	TokenType        string `json:"token_type"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
 }
 
 type SignedInData struct {
 	PageTitle string
+	// GrantedScope is set when the authorization server granted other scopes than requested
+	GrantedScope string
 }
 
 type ErrorPage struct {
@@ -49,33 +58,6 @@ type ErrorPage struct {
 	ErrorDescription string
 }
 
-type tracingTransport struct {
-	originalTransport http.RoundTripper
-}
-
-func (c *tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
-	// Convert from OTEL to Jaeger trace context
-	prop := jaeger.Jaeger{}
-	prop.Inject(r.Context(), propagation.HeaderCarrier(r.Header))
-
-	return c.originalTransport.RoundTrip(r)
-}
-
-var client http.Client
-
-func init() {
-	timeout := time.Duration(5 * time.Second)
-	client = http.Client{
-		Timeout: timeout,
-		Transport: &tracingTransport{
-			originalTransport: otelhttp.NewTransport(&http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			}),
-		},
-	}
-
-}
-
 func (ep GetRedirectEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	tr := otel.Tracer("request")
@@ -93,58 +75,96 @@ func (ep GetRedirectEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Check that the state parameter matches
-	cacheStateKey := "state:" + request.State
-	_cachedState, found := app.Env.Cache.Get(cacheStateKey)
-	if !found {
-		prob := problem.New(http.StatusBadRequest).WithDetail("The state parameter is invalid")
+	// The default provider redirects to the path without a provider name
+	redirectedBy, err := app.Env.Providers.Get(httprouter.ParamsFromContext(ctx).ByName("provider"))
+	if errors.Is(err, provider.ErrUnknownProvider) {
+		prob := problem.New(http.StatusNotFound).WithDetail("Unknown provider")
 		problem.MustWrite(w, prob)
 		return
 	}
-	cachedState := _cachedState.(map[string]string)
-
-	// Look up the info from the user code provided in the state parameter
-	_cache, found := app.Env.Cache.Get(cachedState["user_code"])
-	if !found {
-		prob := problem.New(http.StatusInternalServerError).WithDetail("No user_code found i cached state")
+	if err != nil {
+		prob := problem.New(http.StatusInternalServerError).WithErr(err)
 		problem.MustWrite(w, prob)
 		return
 	}
-	cache := _cache.(map[string]string)
-
-	// Exchange the authorization code for an access token
-
-	// Query params
-	q := url.Values{}
 
-	q.Add("grant_type", "authorization_code")
-	q.Add("code", request.Code)
-	q.Add("redirect_uri", app.Env.BaseUrl+"/auth/redirect")
-	q.Add("client_id", cache["client_id"])
-	q.Add("code_verifier", cache["pkce_verifier"])
-
-	if cache["client_secret"] != "" {
-		q.Add("client_secret", cache["client_secret"])
+	// Check that the state parameter matches and look up the flow it was bound to
+	flow, err := app.Env.Store.GetByState(ctx, request.State)
+	if errors.Is(err, store.ErrNotFound) {
+		prob := problem.New(http.StatusBadRequest).WithDetail("The state parameter is invalid")
+		problem.MustWrite(w, prob)
+		return
 	}
-
-	tokenRequest, err := http.NewRequestWithContext(ctx, "POST", app.Env.TokenEndpoint, bytes.NewBuffer([]byte(q.Encode())))
 	if err != nil {
 		prob := problem.New(http.StatusInternalServerError).WithErr(err)
 		problem.MustWrite(w, prob)
 		return
 	}
-	//	tokenRequest.Header.Set("Content-Type", "application/json")
-	tokenRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := client.Do(tokenRequest)
+	p, c, err := flowProvider(flow)
 	if err != nil {
 		prob := problem.New(http.StatusInternalServerError).WithErr(err)
 		problem.MustWrite(w, prob)
 		return
 	}
-	defer resp.Body.Close()
 
-	tokenResponse, err := ioutil.ReadAll(resp.Body)
+	// A code from one provider must never be exchanged at another, see https://datatracker.ietf.org/doc/html/rfc9207
+	if p != redirectedBy {
+		log.Warn().Str("client_id", flow.ClientId).Str("provider", p.Name).Str("redirected_by", redirectedBy.Name).Msg("Redirect from another provider than the flow signs in with")
+		prob := problem.New(http.StatusBadRequest).WithDetail("The state parameter is invalid")
+		problem.MustWrite(w, prob)
+		return
+	}
+
+	// A flow denied or expired meanwhile keeps its tombstone, the device must never be handed a token for it
+	if flow.Status != store.StatusPending || flow.Expired(time.Now()) {
+		prob := problem.New(http.StatusBadRequest).WithDetail("Code expired or already used, start over on the device")
+		problem.MustWrite(w, prob)
+		return
+	}
+
+	// The state alone is not enough, the redirect must reach the browser the user approved the device in
+	if flow.ApprovedBy == "" || subtle.ConstantTimeCompare([]byte(flow.ApprovedBy), []byte(approval(r))) != 1 {
+		log.Warn().Str("client_id", flow.ClientId).Str("provider", p.Name).Bool("approved", flow.ApprovedBy != "").Msg("Redirect to a browser that did not approve the device")
+		prob := problem.New(http.StatusBadRequest).WithDetail("The device was not approved in this browser, enter the code again")
+		problem.MustWrite(w, prob)
+		return
+	}
+
+	// The user denied access or the authorization server failed, keep a tombstone telling the device why
+	if request.Error != "" {
+		description := request.ErrorDescription
+		if description == "" {
+			description = "The authorization server returned " + request.Error
+		}
+		denyFlow(ctx, flow.DeviceCode, description)
+
+		w.WriteHeader(http.StatusBadRequest)
+
+		tmpl := page("error.html")
+		data := ErrorPage{
+			PageTitle:        "Error",
+			Error:            "Access Denied",
+			ErrorDescription: description,
+		}
+		tmpl.Execute(w, data)
+		return
+	}
+
+	// Exchange the authorization code for an access token, authenticating as the upstream client when it is confidential
+
+	q := url.Values{}
+	q.Add("grant_type", "authorization_code")
+	q.Add("code", request.Code)
+	q.Add("redirect_uri", app.Env.BaseUrl+p.RedirectPath())
+	q.Add("code_verifier", flow.PkceVerifier)
+
+	_, tokenResponse, err := p.Token(ctx, c, q)
+	if errors.Is(err, provider.ErrNotDiscovered) {
+		prob := problem.New(http.StatusServiceUnavailable).WithDetail("The endpoints of the provider are not discovered yet, try again later")
+		problem.MustWrite(w, prob)
+		return
+	}
 	if err != nil {
 		prob := problem.New(http.StatusInternalServerError).WithErr(err)
 		problem.MustWrite(w, prob)
@@ -160,12 +180,15 @@ func (ep GetRedirectEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	}
 
 	if token.AccessToken == "" {
-		app.Env.Cache.Delete(cachedState["user_code"])
-		app.Env.Cache.Delete(cache["device_code"])
+		description := token.ErrorDescription
+		if description == "" {
+			description = "There was an error getting an access token from the authorization server"
+		}
+		denyFlow(ctx, flow.DeviceCode, description)
 
 		w.WriteHeader(http.StatusBadRequest)
 
-		tmpl := template.Must(template.ParseFiles("./endpoint/browser/error.html"))
+		tmpl := page("error.html")
 		data := ErrorPage{
 			PageTitle:        "Error",
 			Error:            "Error Logging In",
@@ -175,21 +198,42 @@ func (ep GetRedirectEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Stash the access token in the cache and display a success message
-	s := map[string]string{
-		"status":         "complete",
-		"token_response": string(tokenResponse),
+	// Stash the access token in the store and display a success message
+	err = app.Env.Store.Complete(ctx, flow.DeviceCode, string(tokenResponse), 120*time.Second)
+	if errors.Is(err, store.ErrNotFound) {
+		prob := problem.New(http.StatusBadRequest).WithDetail("Code expired or already used, start over on the device")
+		problem.MustWrite(w, prob)
+		return
+	}
+	if err != nil {
+		prob := problem.New(http.StatusInternalServerError).WithErr(err)
+		problem.MustWrite(w, prob)
+		return
 	}
-	app.Env.Cache.Set(cache["device_code"], s, 120*time.Second)
-	app.Env.Cache.Delete(cachedState["user_code"])
 
-	tmpl := template.Must(template.ParseFiles("./endpoint/browser/signed-in.html"))
+	// The token was issued to the upstream client, keep which device it was handed to
+	log.Info().Str("client_id", flow.ClientId).Str("provider", p.Name).Str("upstream_client_id", c.Id).Str("scope", flow.Scope).Msg("Device flow completed")
+
+	tmpl := page("signed-in.html")
 	data := SignedInData{
 		PageTitle: "Signed In",
 	}
+
+	// A token response without scope means the requested scope was granted, see https://datatracker.ietf.org/doc/html/rfc6749#section-5.1
+	if token.Scope != "" && !client.ScopesEqual(token.Scope, flow.Scope) {
+		log.Info().Str("client_id", flow.ClientId).Str("requested_scope", flow.Scope).Str("granted_scope", token.Scope).Msg("Granted scope differs from requested")
+		data.GrantedScope = token.Scope
+	}
+
 	tmpl.Execute(w, data)
 }
 
+func denyFlow(ctx context.Context, deviceCode string, description string) {
+	if err := app.Env.Store.Deny(ctx, deviceCode, description); err != nil {
+		log.Error().Err(err).Msg("Unable to deny flow")
+	}
+}
+
 func NewGetRedirectEndpoint() endpoint.EndpointHandler {
 	ep := GetRedirectEndpoint{}
 
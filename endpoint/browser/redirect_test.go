@@ -0,0 +1,133 @@
+package browser
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/provider"
+	"github.com/wraix/device-flow-proxy/store"
+)
+
+// setupRedirectEnv configures the default provider, calling upstream as its token endpoint.
+func setupRedirectEnv(t *testing.T, upstream http.HandlerFunc) *store.MemoryStore {
+	t.Helper()
+	s := setupConsentEnv(t)
+
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+
+	providers, err := provider.NewRegistry("default", &provider.Provider{
+		Name: "default",
+		Endpoints: provider.Endpoints{
+			Authorization: server.URL + "/oauth2/auth",
+			Token:         server.URL + "/oauth2/token",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	app.Env.Providers = providers
+	return s
+}
+
+func getRedirect(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	NewGetRedirectEndpoint().ServeHTTP(w, r)
+	return w
+}
+
+// redirectRequest is the provider redirecting the browser with the given session back with a code, or with no session
+// when it is empty.
+func redirectRequest(state string, session string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/auth/redirect?"+url.Values{"code": {"code"}, "state": {state}}.Encode(), nil)
+	if session != "" {
+		r.AddCookie(&http.Cookie{Name: sessionCookie, Value: session})
+	}
+	return r
+}
+
+func TestRedirectRefusesFlowNotPending(t *testing.T) {
+	s := setupRedirectEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","token_type":"bearer"}`))
+	})
+	ctx := context.Background()
+	now := time.Now()
+
+	denied := createConsentFlow(t, s, "denied", "BBBBBBBB", now.Add(time.Minute))
+	if err := s.Deny(ctx, "denied", "The user denied access"); err != nil {
+		t.Fatalf("Deny: %v", err)
+	}
+	expired := createConsentFlow(t, s, "expired", "CCCCCCCC", now.Add(-time.Second))
+
+	tests := map[string]store.Status{
+		denied:  store.StatusDenied,
+		expired: store.StatusPending,
+	}
+	for state, status := range tests {
+		if w := getRedirect(redirectRequest(state, "")); w.Code != http.StatusBadRequest {
+			t.Errorf("Redirect of %s returned %d, want 400", state, w.Code)
+		}
+
+		// The tombstone telling the device why is kept
+		flow, err := s.GetByState(ctx, state)
+		if err != nil {
+			t.Fatalf("GetByState(%s): %v", state, err)
+		}
+		if flow.Status != status || flow.TokenResponse != "" {
+			t.Errorf("Flow of %s is %v with token %q after the redirect, want %v without token", state, flow.Status, flow.TokenResponse, status)
+		}
+	}
+}
+
+func TestRedirectRequiresApproval(t *testing.T) {
+	exchanged := 0
+	s := setupRedirectEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		exchanged++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token","token_type":"bearer"}`))
+	})
+	ctx := context.Background()
+	state := createConsentFlow(t, s, "device-code", "BDWPHQJT", time.Now().Add(time.Minute))
+
+	// The state alone, eg. sent to a victim signing in without seeing the consent page, is refused
+	if w := getRedirect(redirectRequest(state, "victim")); w.Code != http.StatusBadRequest {
+		t.Fatalf("Redirect of flow not approved returned %d, want 400", w.Code)
+	}
+
+	if w := postConsent(state, "approve", "owner"); w.Code != http.StatusSeeOther {
+		t.Fatalf("Approving returned %d: %s", w.Code, w.Body.String())
+	}
+
+	// Only the browser which approved is redirected back, not another one presenting the state, nor can another one deny
+	denial := httptest.NewRequest(http.MethodGet, "/auth/redirect?"+url.Values{"error": {"access_denied"}, "state": {state}}.Encode(), nil)
+	denial.AddCookie(&http.Cookie{Name: sessionCookie, Value: "victim"})
+	foreign := map[string]*http.Request{
+		"foreign session":        redirectRequest(state, "victim"),
+		"no session":             redirectRequest(state, ""),
+		"foreign session denial": denial,
+	}
+	for name, r := range foreign {
+		if w := getRedirect(r); w.Code != http.StatusBadRequest {
+			t.Errorf("Redirect with %s returned %d, want 400", name, w.Code)
+		}
+	}
+	if exchanged != 0 {
+		t.Fatalf("Code exchanged %d times for browsers which did not approve", exchanged)
+	}
+	if flow, err := s.GetByState(ctx, state); err != nil || flow.Status != store.StatusPending {
+		t.Fatalf("Flow after foreign redirects is %+v, %v, want pending", flow, err)
+	}
+
+	if w := getRedirect(redirectRequest(state, "owner")); w.Code != http.StatusOK {
+		t.Fatalf("Redirect of the approving browser returned %d: %s", w.Code, w.Body.String())
+	}
+	if flow, err := s.GetByState(ctx, state); err != nil || flow.Status != store.StatusComplete || exchanged != 1 {
+		t.Fatalf("Flow after redirect is %+v, %v, exchanged %d times, want complete exchanged once", flow, err, exchanged)
+	}
+}
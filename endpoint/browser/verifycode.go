@@ -1,23 +1,30 @@
 package browser
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/bruteforce"
+	"github.com/wraix/device-flow-proxy/client"
 	"github.com/wraix/device-flow-proxy/endpoint"
 	"github.com/wraix/device-flow-proxy/endpoint/problem"
+	"github.com/wraix/device-flow-proxy/store"
 
 	"github.com/charmixer/oas/api"
 
 	"go.opentelemetry.io/otel"
+
+	"github.com/rs/zerolog/log"
 )
 
 type GetVerifyCodeRequest struct {
@@ -51,62 +58,134 @@ func (ep GetVerifyCodeEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// 	Remove hyphens and convert to uppercase to make it easier for users to enter the code
-	userCode := strings.ToUpper(strings.ReplaceAll(request.Code, "-", ""))
+	// Guessing user codes must be slowed down so live codes cannot be enumerated
+	keys, err := attemptKeys(w, r)
+	if err != nil {
+		prob := problem.New(http.StatusInternalServerError).WithErr(err)
+		problem.MustWrite(w, prob)
+		return
+	}
+
+	required, err := app.Env.BruteForce.ChallengeRequired(ctx, keys)
+	if err != nil {
+		prob := problem.New(http.StatusInternalServerError).WithErr(err)
+		problem.MustWrite(w, prob)
+		return
+	}
+	if required {
+		if err := app.Env.BruteForce.VerifyChallenge(ctx, r); err != nil {
+			prob := problem.New(http.StatusForbidden).WithDetail("Prove you are human before entering the code")
+			problem.MustWrite(w, prob)
+			return
+		}
+	}
+
+	// The attempt is counted before the lookup, so parallel guesses cannot all pass before any is counted
+	now := time.Now()
+	reservation, err := app.Env.BruteForce.Reserve(ctx, keys, now)
+	if errors.Is(err, bruteforce.ErrLockedOut) {
+		log.Warn().Str("ip", clientIp(r)).Time("locked_until", reservation.LockedUntil).Msg("Too many wrong user codes entered")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(reservation.LockedUntil.Sub(now).Seconds()))))
+		prob := problem.New(http.StatusTooManyRequests).WithDetail("Too many wrong codes entered, try again later")
+		problem.MustWrite(w, prob)
+		return
+	}
+	if err != nil {
+		prob := problem.New(http.StatusInternalServerError).WithErr(err)
+		problem.MustWrite(w, prob)
+		return
+	}
 
-	_cache, found := app.Env.Cache.Get(userCode)
-	if !found {
+	// The store is keyed by the hash of the user code, it is hashed on lookup
+	flow, err := getByUserCode(ctx, request.Code)
+	if errors.Is(err, store.ErrNotFound) {
+		app.Env.BruteForce.Fail()
 		prob := problem.New(http.StatusBadRequest).WithDetail("Code not found")
 		problem.MustWrite(w, prob)
+		return
+	}
+	if err != nil {
+		prob := problem.New(http.StatusInternalServerError).WithErr(err)
+		problem.MustWrite(w, prob)
+		return
+	}
+
+	// The code is right, so the attempt is not counted against the browser
+	if err := app.Env.BruteForce.Refund(ctx, reservation); err != nil {
+		log.Error().Err(err).Msg("Unable to refund user code attempt")
+	}
+	if flow.Expired(now) {
+		prob := problem.New(http.StatusBadRequest).WithDetail("Code expired, start over on the device")
+		problem.MustWrite(w, prob)
+		return
 	}
-	cache := _cache.(map[string]string)
 
 	_state, err := endpoint.GenerateRandomBytes(16)
 	if err != nil {
 		prob := problem.New(http.StatusBadRequest).WithErr(err)
 		problem.MustWrite(w, prob)
+		return
 	}
 	state := hex.EncodeToString(_state)
 
 	expiresIn := app.Env.CacheDefaultExpiration
 
-	obj := map[string]string{
-		"user_code": userCode,
-		"iat":       strconv.FormatInt(time.Now().UnixNano(), 10),
-	}
-
-	app.Env.Cache.Set("state:"+state, obj, time.Second*time.Duration(expiresIn))
-
-	pkceVerifier := CodeVerifier{
-		Value: cache["pkce_verifier"],
+	err = app.Env.Store.BindState(ctx, state, flow.DeviceCode, time.Second*time.Duration(expiresIn))
+	if err != nil {
+		prob := problem.New(http.StatusInternalServerError).WithErr(err)
+		problem.MustWrite(w, prob)
+		return
 	}
-	pkceChallenge := pkceVerifier.CodeChallengeS256() // base64_urlencode(hash('sha256', $cache->pkce_verifier, true))
 
-	base, err := url.Parse(app.Env.AuthorizationEndpoint)
+	device, err := app.Env.Clients.Get(flow.ClientId)
 	if err != nil {
 		prob := problem.New(http.StatusInternalServerError).WithErr(err)
 		problem.MustWrite(w, prob)
+		return
 	}
 
-	// Query params
-	q := url.Values{}
-
-	q.Add("response_type", "code")
-	q.Add("client_id", cache["client_id"])
-	q.Add("redirect_uri", app.Env.BaseUrl+"/auth/redirect")
-	q.Add("state", state)
-	q.Add("code_challenge", pkceChallenge)
-	q.Add("code_challenge_method", "S256")
-
-	if cache["scope"] != "" {
-		q.Add("scope", cache["scope"])
+	// Let the user check what is asking for access before signing in, as a code sent by someone else would
+	// otherwise hand them access to the account.
+	tmpl := page("consent.html")
+	data := ConsentPageData{
+		PageTitle:       "Approve Device",
+		FormAction:      "/auth/consent",
+		State:           state,
+		ClientName:      device.Name,
+		Scopes:          client.ParseScope(flow.Scope),
+		DeviceName:      flow.DeviceName,
+		DeviceUserAgent: flow.DeviceUserAgent,
+		RequestedAt:     flow.IssuedAt.UTC().Format(time.RFC1123),
+	}
+	if data.ClientName == "" {
+		data.ClientName = device.Id
 	}
 
-	base.RawQuery = q.Encode()
-
-	authUrl := base.String()
+	// The page must not be framed, so the user cannot be tricked into clicking approve, nor cached as it holds the state
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.Header().Set("Cache-Control", "no-store")
+	tmpl.Execute(w, data)
+}
 
-	http.Redirect(w, r, authUrl, http.StatusFound)
+// getByUserCode returns the flow of a code as entered by the user. Hyphens and spaces are removed and letters upper cased
+// to make it easier to enter the code, and lookalike characters folded as by the user code format of the client. Which
+// client the code is of is not known until it is found, so it is normalized as by every format in use.
+func getByUserCode(ctx context.Context, input string) (*store.Flow, error) {
+	tried := map[string]bool{}
+	for _, format := range app.Env.Clients.UserCodeFormats() {
+		userCode := format.Normalize(input)
+		if tried[userCode] {
+			continue
+		}
+		tried[userCode] = true
+
+		flow, err := app.Env.Store.GetByUserCode(ctx, userCode)
+		if !errors.Is(err, store.ErrNotFound) {
+			return flow, err
+		}
+	}
+	return nil, store.ErrNotFound
 }
 
 func NewGetVerifyCodeEndpoint() endpoint.EndpointHandler {
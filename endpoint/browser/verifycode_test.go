@@ -0,0 +1,40 @@
+package browser
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/bruteforce"
+	"github.com/wraix/device-flow-proxy/client"
+)
+
+func TestVerifyCodeFoldsLookalikes(t *testing.T) {
+	s := setupConsentEnv(t)
+	numeric := client.UserCodeFormat{Charset: client.CharsetNumeric, Length: 9, GroupSize: 3}
+	app.Env.Clients = client.NewStrictRegistry(client.Client{UserCode: client.UserCodeFormat{Charset: client.CharsetBase20, Length: 8}}, client.Client{Id: "tv", UserCode: numeric})
+	app.Env.BruteForce = bruteforce.NewGuard(s, bruteforce.Policy{FreeAttempts: 5, Lockout: time.Minute, MaxLockout: time.Hour, Window: time.Hour})
+	app.Env.CacheDefaultExpiration = 60
+
+	createConsentFlow(t, s, "device-code", "100000010", time.Now().Add(time.Minute))
+
+	// A numeric code typed with letters looking like its digits is found, and not counted as a wrong code
+	r := httptest.NewRequest(http.MethodGet, "/auth/verify_code?"+url.Values{"code": {"IOO-OOO-OlO"}}.Encode(), nil)
+	w := httptest.NewRecorder()
+	NewGetVerifyCodeEndpoint().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Verifying code typed with lookalikes returned %d: %s", w.Code, w.Body.String())
+	}
+
+	attempts, err := s.GetAttempts(context.Background(), "ip:192.0.2.1")
+	if err != nil {
+		t.Fatalf("GetAttempts: %v", err)
+	}
+	if attempts.Failures != 0 {
+		t.Fatalf("%d failures counted for the right code", attempts.Failures)
+	}
+}
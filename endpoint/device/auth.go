@@ -0,0 +1,109 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/client"
+	"github.com/wraix/device-flow-proxy/endpoint/problem"
+)
+
+// ClientAuthenticationRequest holds the client id and the credentials a client may post to the device endpoints,
+// see https://datatracker.ietf.org/doc/html/rfc6749#section-2.3.1 and https://datatracker.ietf.org/doc/html/rfc7523#section-2.2
+type ClientAuthenticationRequest struct {
+	ClientId            string `form:"client_id" oas-desc:"The client id, required unless the client authenticates with basic auth or a client assertion"`
+	ClientSecret        string `form:"client_secret" oas-desc:"The client secret of clients authenticating with client_secret_post"`
+	ClientAssertionType string `form:"client_assertion_type" oas-desc:"urn:ietf:params:oauth:client-assertion-type:jwt-bearer for clients authenticating with private_key_jwt"`
+	ClientAssertion     string `form:"client_assertion" oas-desc:"The signed jwt of clients authenticating with private_key_jwt"`
+}
+
+// authenticateClient authenticates the client of the request. When it fails an error response has been written and ok is false.
+func authenticateClient(ctx context.Context, w http.ResponseWriter, r *http.Request, request ClientAuthenticationRequest) (c client.Client, ok bool) {
+	_, unitOfWork := tr.Start(ctx, "Authenticate client")
+	defer unitOfWork.End()
+
+	credentials := client.Credentials{
+		Method:   client.AuthMethodNone,
+		ClientId: request.ClientId,
+	}
+	methods := 0
+
+	if id, secret, basic := r.BasicAuth(); basic {
+		// Client id and secret are form encoded before being used for basic auth, see https://datatracker.ietf.org/doc/html/rfc6749#section-2.3.1
+		id, idErr := url.QueryUnescape(id)
+		secret, secretErr := url.QueryUnescape(secret)
+		if idErr != nil || secretErr != nil || (request.ClientId != "" && request.ClientId != id) {
+			writeClientAuthenticationError(ctx, w, true)
+			return client.Client{}, false
+		}
+
+		credentials.Method = client.AuthMethodClientSecretBasic
+		credentials.ClientId = id
+		credentials.Secret = secret
+		methods++
+	}
+	if request.ClientSecret != "" {
+		credentials.Method = client.AuthMethodClientSecretPost
+		credentials.Secret = request.ClientSecret
+		methods++
+	}
+	if request.ClientAssertionType != "" || request.ClientAssertion != "" {
+		if request.ClientAssertionType != client.ClientAssertionTypeJwtBearer {
+			writeError(ctx, w, http.StatusBadRequest, ErrorResponse{
+				Error:            "invalid_request",
+				ErrorDescription: "Unsupported client_assertion_type",
+			})
+			return client.Client{}, false
+		}
+
+		credentials.Method = client.AuthMethodPrivateKeyJwt
+		credentials.Assertion = request.ClientAssertion
+		methods++
+	}
+
+	// See https://datatracker.ietf.org/doc/html/rfc6749#section-2.3
+	if methods > 1 {
+		writeError(ctx, w, http.StatusBadRequest, ErrorResponse{
+			Error:            "invalid_request",
+			ErrorDescription: "The client must use only one authentication method",
+		})
+		return client.Client{}, false
+	}
+	if credentials.ClientId == "" && credentials.Method != client.AuthMethodPrivateKeyJwt {
+		prob := problem.NewValidationProblem(http.StatusBadRequest)
+		prob.Add("client_id", "client_id is a required field")
+		problem.MustWrite(w, prob)
+		return client.Client{}, false
+	}
+
+	audiences := []string{app.Env.BaseUrl, app.Env.BaseUrl + r.URL.Path}
+	c, err := app.Env.Clients.Authenticate(credentials, audiences, time.Now())
+	if errors.Is(err, client.ErrUnknownClient) || errors.Is(err, client.ErrAuthenticationFailed) {
+		log.Info().Err(err).Str("client_id", credentials.ClientId).Str("method", credentials.Method).Msg("Client authentication failed")
+		writeClientAuthenticationError(ctx, w, credentials.Method == client.AuthMethodClientSecretBasic)
+		return client.Client{}, false
+	}
+	if err != nil {
+		problem.MustWrite(w, problem.New(http.StatusInternalServerError).WithErr(err))
+		return client.Client{}, false
+	}
+
+	return c, true
+}
+
+// writeClientAuthenticationError responds with invalid_client, see https://datatracker.ietf.org/doc/html/rfc6749#section-5.2
+func writeClientAuthenticationError(ctx context.Context, w http.ResponseWriter, basic bool) {
+	if basic {
+		w.Header().Set("WWW-Authenticate", `Basic realm="device-flow-proxy"`)
+	}
+	writeError(ctx, w, http.StatusUnauthorized, ErrorResponse{
+		Error:            "invalid_client",
+		ErrorDescription: "Client authentication failed",
+	})
+}
@@ -3,28 +3,45 @@ package device
 import (
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/charmixer/oas/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
 
 	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/client"
 	"github.com/wraix/device-flow-proxy/endpoint"
 	"github.com/wraix/device-flow-proxy/endpoint/problem"
+	"github.com/wraix/device-flow-proxy/store"
 )
 
+// maxUserCodeAttempts is how many user codes are generated for a flow before giving up, when they are all in use.
+const maxUserCodeAttempts = 5
+
+var userCodeCollisions = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "user_code_collisions_total",
+	Help: "Number of user codes generated that were already in use by another flow.",
+})
+
 type PostCodeRequest struct {
-	ClientId string `form:"client_id" validate:"required" oas-desc:"The client id"`
-	Scope    string `form:"client_id" oas-desc:"The scopes"`
+	ClientAuthenticationRequest
+	Scope      string `form:"scope" oas-desc:"Space separated list of scopes to request"`
+	Provider   string `form:"provider" oas-desc:"Name of the provider the user should sign in with, for clients not bound to a provider"`
+	DeviceName string `form:"device_name" validate:"max=100" oas-desc:"Name of the device, shown to the user when asked to approve it"`
 }
 type PostCodeResponse struct {
-	DeviceCode      string `json:"device_code" validate:"required" oas-desc:"This is a long string that the device will use to eventually exchange for an access token"`
-	VerificationUri string `json:"verification_uri" validate:"required" oas-desc:"This is the URL the user needs to enter into their phone to start logging in"`
-	UserCode        string `json:"user_code" validate:"required" oas-desc:"This is the text the user will enter at the verification uri."`
-	ExpiresIn       int    `json:"expires_in" validate:"required" oas-desc:"he number of seconds that this set of values is valid. After this amount of time, the device_code and user_code will expire and the device will have to start over"`
-	Interval        int    `json:"interval" validate:"required" oas-desc:"The number of seconds the device should wait between polling to see if the user has finished logging in"`
+	DeviceCode              string `json:"device_code" validate:"required" oas-desc:"This is a long string that the device will use to eventually exchange for an access token"`
+	VerificationUri         string `json:"verification_uri" validate:"required" oas-desc:"This is the URL the user needs to enter into their phone to start logging in"`
+	VerificationUriComplete string `json:"verification_uri_complete,omitempty" oas-desc:"The verification uri including the user code, eg. for showing as a QR code so the user does not need to type the code"`
+	UserCode                string `json:"user_code" validate:"required" oas-desc:"This is the text the user will enter at the verification uri."`
+	ExpiresIn               int    `json:"expires_in" validate:"required" oas-desc:"he number of seconds that this set of values is valid. After this amount of time, the device_code and user_code will expire and the device will have to start over"`
+	Interval                int    `json:"interval" validate:"required" oas-desc:"The number of seconds the device should wait between polling to see if the user has finished logging in"`
 }
 
 // https://golang.org/doc/effective_go#embedding
@@ -48,28 +65,83 @@ func (ep PostCodeEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	deviceCode, pkceVerifier, userCode, userCodeWithNoDash, err := createDeviceFlowCodes(ctx)
+	c, ok := authenticateClient(ctx, w, r, request.ClientAuthenticationRequest)
+	if !ok {
+		return
+	}
+	if disallowed := c.DisallowedScopes(client.ParseScope(request.Scope)); len(disallowed) > 0 {
+		writeError(ctx, w, http.StatusBadRequest, ErrorResponse{
+			Error:            "invalid_scope",
+			ErrorDescription: "The client is not allowed to request the scopes: " + strings.Join(disallowed, " "),
+		})
+		return
+	}
+
+	p, ok := clientProvider(ctx, w, c, request.Provider)
+	if !ok {
+		return
+	}
+
+	deviceCode, pkceVerifier, userCode, userCodeWithNoDash, err := createDeviceFlowCodes(ctx, c.UserCode)
 	if err != nil {
 		e := problem.New(http.StatusInternalServerError).WithErr(err)
 		problem.MustWrite(w, e)
 		return
 	}
 
-	cache := map[string]string{
-		"client_id":     request.ClientId,
-		"scope":         request.Scope,
-		"device_code":   deviceCode,
-		"pkce_verifier": pkceVerifier, // TODO: This should be encryptet.
+	expiresIn := c.ExpiresIn
+	now := time.Now()
+
+	flow := store.Flow{
+		DeviceCode:   deviceCode,
+		UserCode:     userCodeWithNoDash,
+		ClientId:     c.Id,
+		Scope:        strings.Join(client.ParseScope(request.Scope), " "),
+		Provider:     p.Name,
+		PkceVerifier: pkceVerifier,
+		IssuedAt:     now,
+		ExpiresAt:    now.Add(time.Second * time.Duration(expiresIn)),
+		Interval:     c.PollInterval,
+
+		// Shown to the user approving the device
+		DeviceName:      request.DeviceName,
+		DeviceUserAgent: r.UserAgent(),
+	}
+
+	// The user code may be in use by another flow, which must never be taken over. Draw another until one is free.
+	for attempt := 1; ; attempt++ {
+		err = writeToStore(ctx, flow)
+		if !errors.Is(err, store.ErrUserCodeTaken) {
+			break
+		}
+		userCodeCollisions.Inc()
+		if attempt == maxUserCodeAttempts {
+			log.Error().Str("client_id", c.Id).Int("attempts", attempt).Msg("No free user code found, use longer user codes")
+			break
+		}
+
+		if flow.UserCode, err = c.UserCode.Generate(); err != nil {
+			break
+		}
+		userCode = c.UserCode.Group(flow.UserCode)
+	}
+	if err != nil {
+		e := problem.New(http.StatusInternalServerError).WithErr(err)
+		problem.MustWrite(w, e)
+		return
 	}
-	expiresIn := app.Env.CacheDefaultExpiration
-	writeToCache(ctx, deviceCode, userCodeWithNoDash, expiresIn, cache)
 
 	response := PostCodeResponse{
 		DeviceCode:      deviceCode,
 		UserCode:        userCode,
-		VerificationUri: app.Env.BaseUrl + "/device",
+		VerificationUri: verificationUri(),
 		ExpiresIn:       expiresIn,
-		Interval:        app.Env.PollIntervalInSeconds,
+		Interval:        c.PollInterval,
+	}
+
+	// See https://datatracker.ietf.org/doc/html/rfc8628#section-3.3.1
+	if c.VerificationUriComplete {
+		response.VerificationUriComplete = verificationUriComplete(userCode)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -85,23 +157,17 @@ func (ep PostCodeEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func writeToCache(ctx context.Context, deviceCode string, userCodeWithNoDash string, expiresIn int, cache map[string]string) {
-	_, unitOfWork := tr.Start(ctx, "Store in cache")
+func writeToStore(ctx context.Context, flow store.Flow) error {
+	ctx, unitOfWork := tr.Start(ctx, "Store pending flow")
 	defer unitOfWork.End()
 
-	// Rely on the cache to remove entries upon expire to get the codes to expire.
-
-	// Store without the hyphen
-	app.Env.Cache.Set(userCodeWithNoDash, cache, time.Second*time.Duration(expiresIn))
-
-	// Add a placeholder entry with the device code so that the token route knows the request is pending
-	app.Env.Cache.Set(deviceCode, map[string]string{
-		"iat":    strconv.FormatInt(time.Now().UnixNano(), 10),
-		"status": "pending",
-	}, time.Second*time.Duration(expiresIn))
+	// Rely on the store to remove entries once the tombstone following expiry of the codes has expired too.
+	// The user code is stored without the hyphen.
+	ttl := time.Until(flow.ExpiresAt) + time.Second*time.Duration(app.Env.TombstoneExpiration)
+	return app.Env.Store.CreatePendingFlow(ctx, flow, ttl)
 }
 
-func createDeviceFlowCodes(ctx context.Context) (deviceCode string, pkceVerifier string, userCode string, userCodeWithNoDash string, err error) {
+func createDeviceFlowCodes(ctx context.Context, generator client.UserCodeGenerator) (deviceCode string, pkceVerifier string, userCode string, userCodeWithNoDash string, err error) {
 	_, unitOfWork := tr.Start(ctx, "Create device code, pkce verifier and user code")
 	defer unitOfWork.End()
 
@@ -118,13 +184,12 @@ func createDeviceFlowCodes(ctx context.Context) (deviceCode string, pkceVerifier
 	}
 	pkceVerifier = hex.EncodeToString(_pkceVerifierInBytes)
 
-	// If more entropy in the user code is needed increase the number of characters in the generateRandomString call
-	_userCode, err := endpoint.GenerateRandomString(8)
+	// If more entropy in the user code is needed increase the length of the user code format
+	userCodeWithNoDash, err = generator.Generate()
 	if err != nil {
 		return "", "", "", "", err
 	}
-	userCode = _userCode[:4] + "-" + _userCode[4:]
-	userCodeWithNoDash = _userCode[:4] + _userCode[4:]
+	userCode = generator.Group(userCodeWithNoDash)
 
 	return deviceCode, pkceVerifier, userCode, userCodeWithNoDash, nil
 }
@@ -151,6 +216,14 @@ func NewPostCodeEndpoint() endpoint.EndpointHandler {
 				Description: http.StatusText(http.StatusBadRequest),
 				Code:        http.StatusBadRequest,
 				Schema:      problem.ValidationProblem{}, // TODO fix oas to work with: problem.ValidationError{},
+			}, {
+				Description: "The client is not allowed to request the scope, or asked for an unknown provider",
+				Code:        http.StatusBadRequest,
+				Schema:      ErrorResponse{},
+			}, {
+				Description: "The client is not known to the proxy or failed to authenticate",
+				Code:        http.StatusUnauthorized,
+				Schema:      ErrorResponse{},
 			}},
 		}),
 	)
@@ -0,0 +1,65 @@
+package device
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/client"
+	"github.com/wraix/device-flow-proxy/provider"
+	"github.com/wraix/device-flow-proxy/store"
+)
+
+func TestCodeVerificationUriComplete(t *testing.T) {
+	env := app.Env
+	t.Cleanup(func() { app.Env = env })
+
+	providers, err := provider.NewRegistry("default", &provider.Provider{
+		Name:      "default",
+		Endpoints: provider.Endpoints{Authorization: "https://provider.example.com/oauth2/auth", Token: "https://provider.example.com/oauth2/token"},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	defaults := client.Client{
+		ExpiresIn:    300,
+		PollInterval: 5,
+		UserCode:     client.UserCodeFormat{Charset: client.CharsetBase20, Length: 8, GroupSize: 4},
+	}
+	app.Env.BaseUrl = "http://localhost:8080"
+	app.Env.Store = store.NewMemoryStore(time.Minute, time.Minute)
+	app.Env.Providers = providers
+	app.Env.Clients = client.NewStrictRegistry(defaults, client.Client{Id: "tv"}, client.Client{Id: "kiosk", VerificationUriComplete: true})
+
+	for id, complete := range map[string]bool{"tv": false, "kiosk": true} {
+		form := url.Values{"client_id": {id}}
+		r := httptest.NewRequest(http.MethodPost, "/device/code", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		NewPostCodeEndpoint().ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Code of %s returned %d: %s", id, w.Code, w.Body.String())
+		}
+		response := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Unable to decode response %q: %v", w.Body.String(), err)
+		}
+
+		got, ok := response["verification_uri_complete"]
+		if !complete {
+			if ok {
+				t.Errorf("Code of %s returned verification_uri_complete %v, want it left out", id, got)
+			}
+			continue
+		}
+		if want := "http://localhost:8080/device?code=" + response["user_code"].(string); got != want {
+			t.Errorf("Code of %s returned verification_uri_complete %v, want %s", id, got, want)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package device
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/wraix/device-flow-proxy/client"
+)
+
+// Grant types of the token endpoint
+const (
+	// GrantTypeDeviceCode is the device access token request, see https://datatracker.ietf.org/doc/html/rfc8628#section-3.4
+	GrantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+	// GrantTypeRefreshToken is passed through to the provider, see https://datatracker.ietf.org/doc/html/rfc6749#section-6
+	GrantTypeRefreshToken = "refresh_token"
+)
+
+// grantHandler answers a token request of one grant type from an authenticated client, writing the token or an error response.
+type grantHandler func(ctx context.Context, w http.ResponseWriter, c client.Client, request PostTokenRequest)
+
+// grants are the grant types the token endpoint accepts. Any other grant type is rejected with unsupported_grant_type,
+// see https://datatracker.ietf.org/doc/html/rfc6749#section-5.2
+var grants = map[string]grantHandler{
+	GrantTypeDeviceCode:   deviceCodeGrant,
+	GrantTypeRefreshToken: refreshTokenGrant,
+}
+
+// grantTypes returns the accepted grant types, ordered for publishing in the metadata.
+func grantTypes() []string {
+	types := []string{}
+	for grantType := range grants {
+		types = append(types, grantType)
+	}
+	sort.Strings(types)
+	return types
+}
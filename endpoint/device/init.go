@@ -1,7 +1,19 @@
 package device
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+
 	"github.com/charmixer/oas/api"
+	"github.com/rs/zerolog/log"
+
+	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/client"
+	"github.com/wraix/device-flow-proxy/endpoint"
+	"github.com/wraix/device-flow-proxy/endpoint/problem"
+	"github.com/wraix/device-flow-proxy/provider"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/trace"
@@ -14,6 +26,58 @@ var (
 	tr trace.Tracer
 )
 
+// ErrorResponse is the OAuth 2.0 error response, see https://datatracker.ietf.org/doc/html/rfc6749#section-5.2
+type ErrorResponse struct {
+	Error            string `json:"error" oas-desc:"The error code"`
+	ErrorDescription string `json:"error_description,omitempty" oas-desc:"Human readable description of the error"`
+}
+
+func writeError(ctx context.Context, w http.ResponseWriter, status int, e ErrorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := endpoint.WithJsonResponseWriter(ctx, w, e); err != nil {
+		log.Error().Err(err).Str("error", e.Error).Msg("Unable to write json")
+	}
+}
+
+// clientProvider returns the provider a client signs in with. Clients bound to a provider always sign in there, others
+// may ask for one by name, or sign in with the default provider. An error response is written when false is returned.
+func clientProvider(ctx context.Context, w http.ResponseWriter, c client.Client, name string) (*provider.Provider, bool) {
+	if name != "" && c.Provider != "" && name != c.Provider {
+		writeError(ctx, w, http.StatusBadRequest, ErrorResponse{
+			Error:            "invalid_request",
+			ErrorDescription: "The client must sign in with provider " + c.Provider,
+		})
+		return nil, false
+	}
+	if c.Provider != "" {
+		name = c.Provider
+	}
+
+	p, err := app.Env.Providers.Get(name)
+	if errors.Is(err, provider.ErrUnknownProvider) {
+		writeError(ctx, w, http.StatusBadRequest, ErrorResponse{
+			Error:            "invalid_request",
+			ErrorDescription: "Unknown provider " + name,
+		})
+		return nil, false
+	}
+	if err != nil {
+		problem.MustWrite(w, problem.New(http.StatusInternalServerError).WithErr(err))
+		return nil, false
+	}
+	return p, true
+}
+
+func verificationUri() string {
+	return app.Env.BaseUrl + "/device"
+}
+
+// verificationUriComplete is the verification uri with the user code filled in, see https://datatracker.ietf.org/doc/html/rfc8628#section-3.3.1
+func verificationUriComplete(userCode string) string {
+	return verificationUri() + "?" + url.Values{"code": {userCode}}.Encode()
+}
+
 func init() {
 	tr = otel.Tracer("request")
 }
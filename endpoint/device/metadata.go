@@ -0,0 +1,94 @@
+package device
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/charmixer/oas/api"
+
+	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/client"
+	"github.com/wraix/device-flow-proxy/endpoint"
+	"github.com/wraix/device-flow-proxy/endpoint/problem"
+)
+
+type GetMetadataRequest struct{}
+
+// GetMetadataResponse is the authorization server metadata of the proxy, see https://datatracker.ietf.org/doc/html/rfc8414#section-2
+type GetMetadataResponse struct {
+	Issuer                                     string   `json:"issuer" oas-desc:"The base url of the proxy"`
+	DeviceAuthorizationEndpoint                string   `json:"device_authorization_endpoint" oas-desc:"Where devices request a device and user code"`
+	TokenEndpoint                              string   `json:"token_endpoint" oas-desc:"Where devices exchange the device code for tokens"`
+	GrantTypesSupported                        []string `json:"grant_types_supported" oas-desc:"Grant types accepted by the token endpoint"`
+	ResponseTypesSupported                     []string `json:"response_types_supported" oas-desc:"Always empty, the proxy has no authorization endpoint of its own"`
+	CodeChallengeMethodsSupported              []string `json:"code_challenge_methods_supported" oas-desc:"PKCE methods used when signing users in upstream"`
+	TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported" oas-desc:"How clients may authenticate to the proxy"`
+	TokenEndpointAuthSigningAlgValuesSupported []string `json:"token_endpoint_auth_signing_alg_values_supported" oas-desc:"Algorithms private_key_jwt assertions may be signed with"`
+	ScopesSupported                            []string `json:"scopes_supported,omitempty" oas-desc:"Scopes published by the default provider"`
+	RevocationEndpoint                         string   `json:"revocation_endpoint,omitempty" oas-desc:"Revocation endpoint of the default provider"`
+	IntrospectionEndpoint                      string   `json:"introspection_endpoint,omitempty" oas-desc:"Introspection endpoint of the default provider"`
+	UserinfoEndpoint                           string   `json:"userinfo_endpoint,omitempty" oas-desc:"Userinfo endpoint of the default provider"`
+	JwksUri                                    string   `json:"jwks_uri,omitempty" oas-desc:"Keys of the default provider, which signs the tokens"`
+}
+
+// https://golang.org/doc/effective_go#embedding
+type GetMetadataEndpoint struct {
+	endpoint.Endpoint
+}
+
+func (ep GetMetadataEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s execution", r.URL.Path))
+	defer span.End()
+
+	// Tokens are issued by the default provider, so that is where they are revoked, introspected and verified
+	upstream := app.Env.Providers.Default()
+	endpoints := upstream.Current()
+
+	response := GetMetadataResponse{
+		Issuer:                                     app.Env.BaseUrl,
+		DeviceAuthorizationEndpoint:                app.Env.BaseUrl + "/device/code",
+		TokenEndpoint:                              app.Env.BaseUrl + "/device/token",
+		GrantTypesSupported:                        grantTypes(),
+		ResponseTypesSupported:                     []string{},
+		CodeChallengeMethodsSupported:              []string{"S256"},
+		TokenEndpointAuthMethodsSupported:          client.AuthMethods,
+		TokenEndpointAuthSigningAlgValuesSupported: client.AssertionSigningAlgorithms,
+		ScopesSupported:                            upstream.ScopesSupported(),
+		RevocationEndpoint:                         endpoints.Revocation,
+		IntrospectionEndpoint:                      endpoints.Introspection,
+		UserinfoEndpoint:                           endpoints.Userinfo,
+		JwksUri:                                    endpoints.JwksUri,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := endpoint.WithJsonResponseWriter(ctx, w, response); err != nil {
+		problem.MustWrite(w, err)
+		return
+	}
+}
+
+func NewGetMetadataEndpoint() endpoint.EndpointHandler {
+	ep := GetMetadataEndpoint{}
+
+	ep.Setup(
+		endpoint.WithSpecification(api.Path{
+			Summary:     "Get the authorization server metadata of the proxy",
+			Description: `Lets devices discover the device authorization and token endpoints of the proxy, see https://datatracker.ietf.org/doc/html/rfc8414`,
+			Tags:        OPENAPI_TAGS,
+
+			Request: api.Request{
+				Description: ``,
+				Schema:      GetMetadataRequest{},
+			},
+
+			Responses: []api.Response{{
+				Description: http.StatusText(http.StatusOK),
+				Code:        http.StatusOK,
+				Schema:      GetMetadataResponse{},
+			}},
+		}),
+	)
+
+	return ep
+}
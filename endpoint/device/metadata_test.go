@@ -0,0 +1,55 @@
+package device
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/provider"
+)
+
+func TestMetadata(t *testing.T) {
+	env := app.Env
+	t.Cleanup(func() { app.Env = env })
+
+	providers, err := provider.NewRegistry("default", &provider.Provider{
+		Name: "default",
+		Endpoints: provider.Endpoints{
+			Authorization: "https://provider.example.com/oauth2/auth",
+			Token:         "https://provider.example.com/oauth2/token",
+			Revocation:    "https://provider.example.com/oauth2/revoke",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	app.Env.BaseUrl = "https://proxy.example.com"
+	app.Env.Providers = providers
+
+	r := httptest.NewRequest(http.MethodGet, "/.well-known/oauth-authorization-server", nil)
+	w := httptest.NewRecorder()
+	NewGetMetadataEndpoint().ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Metadata returned %d: %s", w.Code, w.Body.String())
+	}
+	metadata := GetMetadataResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &metadata); err != nil {
+		t.Fatalf("Unable to decode metadata %q: %v", w.Body.String(), err)
+	}
+
+	// The endpoints of the proxy are where devices reach it, the others those of the provider issuing the tokens
+	tests := map[string][2]string{
+		"issuer":                        {metadata.Issuer, "https://proxy.example.com"},
+		"device_authorization_endpoint": {metadata.DeviceAuthorizationEndpoint, "https://proxy.example.com/device/code"},
+		"token_endpoint":                {metadata.TokenEndpoint, "https://proxy.example.com/device/token"},
+		"revocation_endpoint":           {metadata.RevocationEndpoint, "https://provider.example.com/oauth2/revoke"},
+	}
+	for name, test := range tests {
+		if test[0] != test[1] {
+			t.Errorf("%s is %q, want %q", name, test[0], test[1])
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package device
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/charmixer/oas/api"
+	"github.com/skip2/go-qrcode"
+
+	"github.com/wraix/device-flow-proxy/endpoint"
+	"github.com/wraix/device-flow-proxy/endpoint/problem"
+)
+
+const (
+	qrDefaultSize  = 256
+	contentTypeSvg = "image/svg+xml"
+	contentTypePng = "image/png"
+)
+
+var qrRecoveryLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+type GetQrRequest struct {
+	UserCode string `query:"user_code" validate:"required,max=64" oas-desc:"The user code to include in the verification uri"`
+	Format   string `query:"format" validate:"omitempty,oneof=png svg" oas-desc:"Image format, png or svg. Defaults to png"`
+	Size     int    `query:"size" validate:"omitempty,min=64,max=1024" oas-desc:"Width and height of the image in pixels. Defaults to 256"`
+	Level    string `query:"level" validate:"omitempty,oneof=L M Q H" oas-desc:"Error correction level, L (7%), M (15%), Q (25%) or H (30%). Defaults to M"`
+}
+
+// https://golang.org/doc/effective_go#embedding
+type GetQrEndpoint struct {
+	endpoint.Endpoint
+}
+
+func (ep GetQrEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, span := tr.Start(ctx, fmt.Sprintf("%s execution", r.URL.Path))
+	defer span.End()
+
+	request := GetQrRequest{}
+	if err := endpoint.WithRequestQueryParser(ctx, r, &request); err != nil {
+		problem.MustWrite(w, err)
+		return
+	}
+
+	if err := endpoint.WithRequestValidation(ctx, &request); err != nil {
+		problem.MustWrite(w, err)
+		return
+	}
+
+	size := request.Size
+	if size == 0 {
+		size = qrDefaultSize
+	}
+	level, ok := qrRecoveryLevels[request.Level]
+	if !ok {
+		level = qrcode.Medium
+	}
+
+	// The code is only ever encoded into the verification uri of this proxy, so the endpoint cannot be used to
+	// generate QR codes for arbitrary content. Whether the user code exists is not checked, as that would allow
+	// guessing user codes.
+	qr, err := qrcode.New(verificationUriComplete(request.UserCode), level)
+	if err != nil {
+		problem.MustWrite(w, problem.New(http.StatusInternalServerError).WithErr(err))
+		return
+	}
+
+	var image []byte
+	contentType := contentTypePng
+	if request.Format == "svg" {
+		contentType = contentTypeSvg
+		image = qrToSvg(qr, size)
+	} else {
+		image, err = qr.PNG(size)
+		if err != nil {
+			problem.MustWrite(w, problem.New(http.StatusInternalServerError).WithErr(err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(image)
+}
+
+// qrToSvg draws the modules of the QR code, including the quiet zone, as a single svg path.
+func qrToSvg(qr *qrcode.QRCode, size int) []byte {
+	bitmap := qr.Bitmap()
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, len(bitmap), len(bitmap))
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="#ffffff"/><path fill="#000000" d="`)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+
+	return b.Bytes()
+}
+
+func NewGetQrEndpoint() endpoint.EndpointHandler {
+	ep := GetQrEndpoint{}
+
+	ep.Setup(
+		endpoint.WithSpecification(api.Path{
+			Summary:     "QR code of the verification uri",
+			Description: `Renders verification_uri_complete for a user code as a QR code, for devices that can display images but cannot generate QR codes`,
+			Tags:        OPENAPI_TAGS,
+
+			Request: api.Request{
+				Description: ``,
+				Schema:      GetQrRequest{},
+			},
+
+			Responses: []api.Response{{
+				Description: "The QR code image",
+				Code:        http.StatusOK,
+				ContentType: []string{contentTypePng, contentTypeSvg},
+			}, {
+				Description: http.StatusText(http.StatusBadRequest),
+				Code:        http.StatusBadRequest,
+				Schema:      problem.ValidationProblem{},
+			}},
+		}),
+	)
+
+	return ep
+}
@@ -0,0 +1,109 @@
+package device
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/store"
+)
+
+func serveQr(t *testing.T, query url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	env := app.Env
+	t.Cleanup(func() { app.Env = env })
+	app.Env.BaseUrl = "http://localhost:8080"
+
+	r := httptest.NewRequest(http.MethodGet, "/device/qr?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+	NewGetQrEndpoint().ServeHTTP(w, r)
+	return w
+}
+
+func TestQrPng(t *testing.T) {
+	for _, size := range []int{0, 64, 1024} {
+		query := url.Values{"user_code": {"BDWP-HQJT"}}
+		want := qrDefaultSize
+		if size != 0 {
+			query.Set("size", strconv.Itoa(size))
+			want = size
+		}
+
+		w := serveQr(t, query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("QR of size %d returned %d: %s", size, w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != contentTypePng {
+			t.Fatalf("Content-Type is %q, want %s", ct, contentTypePng)
+		}
+		image, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("Unable to decode png: %v", err)
+		}
+		if bounds := image.Bounds(); bounds.Dx() != want || bounds.Dy() != want {
+			t.Errorf("QR of size %d is %dx%d, want %dx%d", size, bounds.Dx(), bounds.Dy(), want, want)
+		}
+	}
+}
+
+func TestQrSvg(t *testing.T) {
+	w := serveQr(t, url.Values{"user_code": {"BDWP-HQJT"}, "format": {"svg"}, "size": {"128"}, "level": {"H"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("QR returned %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != contentTypeSvg {
+		t.Fatalf("Content-Type is %q, want %s", ct, contentTypeSvg)
+	}
+	if body := w.Body.String(); !strings.HasPrefix(body, "<svg ") || !strings.Contains(body, `width="128" height="128"`) {
+		t.Fatalf("QR is not an svg of 128 pixels: %s", body)
+	}
+}
+
+func TestQrBounds(t *testing.T) {
+	tests := []url.Values{
+		{},
+		{"user_code": {strings.Repeat("B", 65)}},
+		{"user_code": {"BDWP-HQJT"}, "size": {"63"}},
+		{"user_code": {"BDWP-HQJT"}, "size": {"1025"}},
+		{"user_code": {"BDWP-HQJT"}, "level": {"X"}},
+		{"user_code": {"BDWP-HQJT"}, "format": {"gif"}},
+	}
+	for _, query := range tests {
+		if w := serveQr(t, query); w.Code != http.StatusBadRequest {
+			t.Errorf("QR of %v returned %d, want 400", query, w.Code)
+		}
+	}
+}
+
+// Expired and unknown user codes get a QR code like live ones, as telling them apart would allow guessing codes
+func TestQrUnknownUserCode(t *testing.T) {
+	env := app.Env
+	t.Cleanup(func() { app.Env = env })
+
+	s := store.NewMemoryStore(time.Minute, time.Minute)
+	now := time.Now()
+	for userCode, expiresAt := range map[string]time.Time{"BDWPHQJT": now.Add(time.Minute), "CDWPHQJT": now.Add(-time.Second)} {
+		flow := store.Flow{DeviceCode: "device-" + userCode, UserCode: userCode, ClientId: "tv", IssuedAt: now, ExpiresAt: expiresAt}
+		if err := s.CreatePendingFlow(context.Background(), flow, time.Minute); err != nil {
+			t.Fatalf("CreatePendingFlow: %v", err)
+		}
+	}
+	app.Env.Store = s
+
+	live := serveQr(t, url.Values{"user_code": {"BDWP-HQJT"}, "format": {"svg"}})
+	for _, userCode := range []string{"CDWP-HQJT", "ZZZZ-ZZZZ"} {
+		w := serveQr(t, url.Values{"user_code": {userCode}, "format": {"svg"}})
+		if w.Code != live.Code || w.Header().Get("Content-Type") != live.Header().Get("Content-Type") {
+			t.Errorf("QR of %s returned %d %s, of a live code %d %s", userCode, w.Code, w.Header().Get("Content-Type"), live.Code, live.Header().Get("Content-Type"))
+		}
+	}
+}
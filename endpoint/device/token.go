@@ -2,27 +2,34 @@ package device
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
 	"github.com/charmixer/oas/api"
 
 	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/client"
 	"github.com/wraix/device-flow-proxy/endpoint"
 	"github.com/wraix/device-flow-proxy/endpoint/problem"
+	"github.com/wraix/device-flow-proxy/provider"
+	"github.com/wraix/device-flow-proxy/store"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type PostTokenRequest struct {
-	ClientId   string `form:"client_id" validate:"required" oas-desc:"The client id"`
-	DeviceCode string `form:"device_code" validate:"required" oas-desc:"The device code"`
-	GrantType  string `form:"grant_type" validate:"required" oas-desc:"The grant type"`
-}
-
-type PostTokenError struct {
-	Error            string `json:"error"`
-	ErrorDescription string `json:"error_description,omitempty"`
+	ClientAuthenticationRequest
+	GrantType    string `form:"grant_type" validate:"required" oas-desc:"The grant type, urn:ietf:params:oauth:grant-type:device_code or refresh_token"`
+	DeviceCode   string `form:"device_code" validate:"required_if=GrantType urn:ietf:params:oauth:grant-type:device_code" oas-desc:"The device code"`
+	RefreshToken string `form:"refresh_token" oas-desc:"The refresh token issued with the access token, required by the refresh_token grant"`
+	Scope        string `form:"scope" oas-desc:"Space separated list of scopes to refresh the access token with, at most those originally granted"`
+	Provider     string `form:"provider" oas-desc:"Name of the provider that issued the refresh token, when it was requested at the device code endpoint"`
 }
 
 // https://golang.org/doc/effective_go#embedding
@@ -46,65 +53,181 @@ func (ep PostTokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	c, ok := authenticateClient(ctx, w, r, request.ClientAuthenticationRequest)
+	if !ok {
+		return
+	}
+
+	grant, ok := grants[request.GrantType]
+	if !ok {
+		writeError(ctx, w, http.StatusBadRequest, ErrorResponse{
+			Error:            "unsupported_grant_type",
+			ErrorDescription: "The grant type " + request.GrantType + " is not supported",
+		})
+		return
+	}
+	grant(ctx, w, c, request)
+}
+
+// deviceCodeGrant hands the device the token once the user signed in, see https://datatracker.ietf.org/doc/html/rfc8628#section-3.5
+func deviceCodeGrant(ctx context.Context, w http.ResponseWriter, c client.Client, request PostTokenRequest) {
 	deviceCode := request.DeviceCode
 
-	// TODO add rate limiting in middleware
+	// Check if the device code is in the store, which only knows the hash of it
+	flow, err := app.Env.Store.GetByDeviceCode(ctx, deviceCode)
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(ctx, w, http.StatusBadRequest, ErrorResponse{Error: "invalid_grant"})
+		return
+	}
+	if err != nil {
+		e := problem.New(http.StatusInternalServerError).WithErr(err)
+		problem.MustWrite(w, e)
+		return
+	}
+
+	// The device code is bound to the client it was issued to, see https://datatracker.ietf.org/doc/html/rfc8628#section-3.4
+	// Another client presenting it may have stolen it, so nothing about the flow is revealed.
+	if flow.ClientId != c.Id {
+		trace.SpanFromContext(ctx).AddEvent("device code presented by another client")
+		log.Warn().Str("event", "device_code_client_mismatch").Str("client_id", c.Id).Str("issued_to", flow.ClientId).Str("provider", flow.Provider).Msg("Device code presented by another client than it was issued to")
+		writeError(ctx, w, http.StatusBadRequest, ErrorResponse{Error: "invalid_grant"})
+		return
+	}
 
-	// Check if the device code is in the cache
-	_data, found := app.Env.Cache.Get(deviceCode)
-	if !found {
-		w.Header().Set("Content-Type", "application/json")
-		e := PostTokenError{
-			Error: "invalid_grant",
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		if err := endpoint.WithJsonResponseWriter(ctx, w, e); err != nil {
-			log.Error().Err(err).Str("hint", "device code not found in cache").Msg("Unable to write json")
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+	if flow.Status == store.StatusDenied {
+		writeError(ctx, w, http.StatusBadRequest, ErrorResponse{
+			Error:            "access_denied",
+			ErrorDescription: flow.ErrorDescription,
+		})
 		return
 	}
-	data := _data.(map[string]string)
 
-	if data["status"] == "pending" {
-		w.Header().Set("Content-Type", "application/json")
-		e := PostTokenError{
-			Error: "authorization_pending",
-		}
-		w.WriteHeader(http.StatusBadRequest)
-		if err := endpoint.WithJsonResponseWriter(ctx, w, e); err != nil {
-			log.Error().Err(err).Str("status", data["status"]).Msg("Unable to write json")
-			w.WriteHeader(http.StatusInternalServerError)
-		}
+	if flow.Status == store.StatusPending && flow.Expired(time.Now()) {
+		writeError(ctx, w, http.StatusBadRequest, ErrorResponse{
+			Error:            "expired_token",
+			ErrorDescription: "The device code has expired, start over with a new code",
+		})
 		return
 	}
 
-	if data["status"] != "complete" {
-		w.Header().Set("Content-Type", "application/json")
-		e := PostTokenError{
-			Error: "invalid_grant",
+	if flow.Status == store.StatusPending {
+		// Enforce the poll interval, see https://datatracker.ietf.org/doc/html/rfc8628#section-3.5
+		poll, err := app.Env.Store.Poll(ctx, flow.DeviceCode, time.Now())
+		if err != nil {
+			e := problem.New(http.StatusInternalServerError).WithErr(err)
+			problem.MustWrite(w, e)
+			return
 		}
-		w.WriteHeader(http.StatusBadRequest)
-		if err := endpoint.WithJsonResponseWriter(ctx, w, e); err != nil {
-			log.Error().Err(err).Str("status", data["status"]).Msg("Unable to write json")
-			w.WriteHeader(http.StatusInternalServerError)
+
+		if poll.SlowDowns > app.Env.MaxSlowDowns {
+			// The device keeps ignoring slow_down, cut it off
+			log.Warn().Str("client_id", flow.ClientId).Int("slow_downs", poll.SlowDowns).Msg("Denying device flow polled too fast")
+			description := "The device polled faster than the interval too many times"
+			if err := app.Env.Store.Deny(ctx, flow.DeviceCode, description); err != nil {
+				log.Error().Err(err).Msg("Unable to deny flow")
+			}
+			writeError(ctx, w, http.StatusBadRequest, ErrorResponse{
+				Error:            "access_denied",
+				ErrorDescription: description,
+			})
+			return
+		}
+
+		if poll.SlowDown {
+			writeError(ctx, w, http.StatusBadRequest, ErrorResponse{Error: "slow_down"})
+			return
 		}
+
+		writeError(ctx, w, http.StatusBadRequest, ErrorResponse{Error: "authorization_pending"})
 		return
 	}
 
-	// Everything is awesome
+	if flow.Status != store.StatusComplete {
+		writeError(ctx, w, http.StatusBadRequest, ErrorResponse{Error: "invalid_grant"})
+		return
+	}
 
-	deleteCacheForDeviceCode(ctx, deviceCode)
+	// Everything is awesome, unless a concurrent poll got the token first. Only the poll removing the flow gets it.
+	redeemed, err := redeemFlowForDeviceCode(ctx, flow.DeviceCode)
+	if errors.Is(err, store.ErrNotFound) {
+		writeError(ctx, w, http.StatusBadRequest, ErrorResponse{Error: "invalid_grant"})
+		return
+	}
+	if err != nil {
+		e := problem.New(http.StatusInternalServerError).WithErr(err)
+		problem.MustWrite(w, e)
+		return
+	}
 
 	// Just return what hydra made as an access token. No output validation.
 	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(data["token_response"]))
+	w.Write([]byte(redeemed.TokenResponse))
+}
+
+// refreshTokenGrant refreshes the access token at the provider, so devices never need to know its token endpoint
+func refreshTokenGrant(ctx context.Context, w http.ResponseWriter, c client.Client, request PostTokenRequest) {
+	// See https://datatracker.ietf.org/doc/html/rfc6749#section-6
+	if request.RefreshToken == "" {
+		writeError(ctx, w, http.StatusBadRequest, ErrorResponse{
+			Error:            "invalid_request",
+			ErrorDescription: "The refresh_token parameter is required",
+		})
+		return
+	}
+
+	if disallowed := c.DisallowedScopes(client.ParseScope(request.Scope)); len(disallowed) > 0 {
+		writeError(ctx, w, http.StatusBadRequest, ErrorResponse{
+			Error:            "invalid_scope",
+			ErrorDescription: "The client is not allowed to request the scopes: " + strings.Join(disallowed, " "),
+		})
+		return
+	}
+
+	p, ok := clientProvider(ctx, w, c, request.Provider)
+	if !ok {
+		return
+	}
+
+	q := url.Values{}
+	q.Add("grant_type", GrantTypeRefreshToken)
+	q.Add("refresh_token", request.RefreshToken)
+	if request.Scope != "" {
+		q.Add("scope", strings.Join(client.ParseScope(request.Scope), " "))
+	}
+
+	status, tokenResponse, err := p.Token(ctx, p.UpstreamClient(c), q)
+	if errors.Is(err, provider.ErrNotDiscovered) {
+		e := problem.New(http.StatusServiceUnavailable).WithDetail("The endpoints of the provider are not discovered yet, try again later")
+		problem.MustWrite(w, e)
+		return
+	}
+	if err != nil {
+		e := problem.New(http.StatusBadGateway).WithErr(err)
+		problem.MustWrite(w, e)
+		return
+	}
+
+	// Errors about the refresh token are for the device, any other failure is between the proxy and the provider
+	if status != http.StatusOK && status != http.StatusBadRequest {
+		log.Error().Str("client_id", c.Id).Str("provider", p.Name).Int("status", status).Bytes("response", tokenResponse).Msg("Provider failed to refresh token")
+		e := problem.New(http.StatusBadGateway).WithDetail("The provider failed to refresh the token")
+		problem.MustWrite(w, e)
+		return
+	}
+
+	log.Info().Str("client_id", c.Id).Str("provider", p.Name).Int("status", status).Msg("Refreshed token")
+
+	// Just return what the provider responded. No output validation.
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(tokenResponse)
 }
 
-func deleteCacheForDeviceCode(ctx context.Context, deviceCode string) {
-	_, unitOfWork := tr.Start(ctx, "Delete cache for device code")
+func redeemFlowForDeviceCode(ctx context.Context, deviceCode string) (*store.Flow, error) {
+	ctx, unitOfWork := tr.Start(ctx, "Redeem flow for device code")
 	defer unitOfWork.End()
-	app.Env.Cache.Delete(deviceCode)
+	return app.Env.Store.Redeem(ctx, deviceCode)
 }
 
 func NewPostTokenEndpoint() endpoint.EndpointHandler {
@@ -112,7 +235,7 @@ func NewPostTokenEndpoint() endpoint.EndpointHandler {
 
 	ep.Setup(
 		endpoint.WithSpecification(api.Path{
-			Summary:     "Exchange device code for access token",
+			Summary:     "Exchange device code for access token, or refresh the access token",
 			Description: ``,
 			Tags:        OPENAPI_TAGS,
 
@@ -124,14 +247,22 @@ func NewPostTokenEndpoint() endpoint.EndpointHandler {
 			Responses: []api.Response{{
 				Description: "The access token from the OAuth2 provider",
 				Code:        http.StatusOK,
+			}, {
+				Description: "The provider failed to refresh the access token",
+				Code:        http.StatusBadGateway,
+				Schema:      problem.ProblemDetails{},
 			}, {
 				Description: http.StatusText(http.StatusBadRequest),
 				Code:        http.StatusBadRequest,
-				Schema:      PostTokenError{},
+				Schema:      ErrorResponse{},
 			}, {
 				Description: http.StatusText(http.StatusBadRequest),
 				Code:        http.StatusBadRequest,
 				Schema:      problem.ValidationProblem{},
+			}, {
+				Description: "The client is not known to the proxy or failed to authenticate",
+				Code:        http.StatusUnauthorized,
+				Schema:      ErrorResponse{},
 			}},
 		}),
 	)
@@ -0,0 +1,192 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wraix/device-flow-proxy/app"
+	"github.com/wraix/device-flow-proxy/client"
+	"github.com/wraix/device-flow-proxy/provider"
+	"github.com/wraix/device-flow-proxy/store"
+)
+
+// setupTokenEnv configures a store holding a pending flow issued to the client tv, and the clients tv and thief.
+// The environment is restored when the test ends.
+func setupTokenEnv(t *testing.T) {
+	t.Helper()
+
+	env := app.Env
+	t.Cleanup(func() { app.Env = env })
+
+	s := store.NewMemoryStore(time.Minute, time.Minute)
+	now := time.Now()
+	flow := store.Flow{
+		DeviceCode: "device-code",
+		UserCode:   "BDWPHQJT",
+		ClientId:   "tv",
+		Status:     store.StatusPending,
+		IssuedAt:   now,
+		ExpiresAt:  now.Add(time.Minute),
+		Interval:   5,
+	}
+	if err := s.CreatePendingFlow(context.Background(), flow, time.Minute); err != nil {
+		t.Fatalf("CreatePendingFlow: %v", err)
+	}
+
+	app.Env.BaseUrl = "http://localhost:8080"
+	app.Env.Store = s
+	app.Env.Clients = client.NewStrictRegistry(client.Client{}, client.Client{Id: "tv"}, client.Client{Id: "thief"})
+	app.Env.MaxSlowDowns = 3
+}
+
+// serveToken posts form to the token endpoint.
+func serveToken(form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/device/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	NewPostTokenEndpoint().ServeHTTP(w, r)
+	return w
+}
+
+// postToken posts form to the token endpoint and returns the status and the error response.
+func postToken(t *testing.T, form url.Values) (int, ErrorResponse) {
+	t.Helper()
+
+	w := serveToken(form)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type is %q, want application/json", ct)
+	}
+	e := ErrorResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatalf("Unable to decode error response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, e
+}
+
+func TestTokenDeviceCodeOfAnotherClient(t *testing.T) {
+	setupTokenEnv(t)
+
+	status, e := postToken(t, url.Values{
+		"grant_type":  {GrantTypeDeviceCode},
+		"client_id":   {"thief"},
+		"device_code": {"device-code"},
+	})
+	if status != http.StatusBadRequest || e.Error != "invalid_grant" {
+		t.Fatalf("Device code of another client returned %d %q, want 400 invalid_grant", status, e.Error)
+	}
+	// Nothing about the flow is told to the client presenting it
+	if e.ErrorDescription != "" {
+		t.Fatalf("Device code of another client returned the description %q", e.ErrorDescription)
+	}
+
+	// The client it was issued to can still use it
+	status, e = postToken(t, url.Values{
+		"grant_type":  {GrantTypeDeviceCode},
+		"client_id":   {"tv"},
+		"device_code": {"device-code"},
+	})
+	if status != http.StatusBadRequest || e.Error != "authorization_pending" {
+		t.Fatalf("Device code of the client returned %d %q, want 400 authorization_pending", status, e.Error)
+	}
+}
+
+func TestTokenUnsupportedGrantType(t *testing.T) {
+	setupTokenEnv(t)
+
+	status, e := postToken(t, url.Values{
+		"grant_type": {"password"},
+		"client_id":  {"tv"},
+	})
+	if status != http.StatusBadRequest || e.Error != "unsupported_grant_type" {
+		t.Fatalf("Grant type password returned %d %q, want 400 unsupported_grant_type", status, e.Error)
+	}
+}
+
+// setupRefreshEnv configures the default provider with its own upstream client, calling upstream as its token endpoint.
+func setupRefreshEnv(t *testing.T, upstream http.HandlerFunc) {
+	t.Helper()
+	setupTokenEnv(t)
+
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+
+	providers, err := provider.NewRegistry("default", &provider.Provider{
+		Name: "default",
+		Endpoints: provider.Endpoints{
+			Authorization: server.URL + "/oauth2/auth",
+			Token:         server.URL + "/oauth2/token",
+		},
+		Client: client.Client{Id: "proxy", AuthMethod: client.AuthMethodClientSecretBasic, Secret: "proxy-secret"},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	app.Env.Providers = providers
+}
+
+func TestTokenRefresh(t *testing.T) {
+	setupRefreshEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		// The provider is called as the upstream client of the proxy, not as the device
+		if id, secret, ok := r.BasicAuth(); !ok || id != "proxy" || secret != "proxy-secret" {
+			t.Errorf("Provider called with basic auth %q %q %v, want the upstream client", id, secret, ok)
+		}
+		if r.PostFormValue("grant_type") != GrantTypeRefreshToken || r.PostFormValue("refresh_token") != "refresh-token" || r.PostFormValue("scope") != "openid" {
+			t.Errorf("Provider called with %v", r.PostForm)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"access-token","token_type":"bearer","expires_in":3600}`))
+	})
+
+	w := serveToken(url.Values{
+		"grant_type":    {GrantTypeRefreshToken},
+		"client_id":     {"tv"},
+		"refresh_token": {"refresh-token"},
+		"scope":         {"openid"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Refresh returned %d: %s", w.Code, w.Body.String())
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Fatalf("Cache-Control is %q, want no-store", cc)
+	}
+	if body := w.Body.String(); body != `{"access_token":"access-token","token_type":"bearer","expires_in":3600}` {
+		t.Fatalf("Refresh returned %s, want the response of the provider", body)
+	}
+}
+
+func TestTokenRefreshError(t *testing.T) {
+	setupRefreshEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant","error_description":"The refresh token was revoked"}`))
+	})
+
+	status, e := postToken(t, url.Values{
+		"grant_type":    {GrantTypeRefreshToken},
+		"client_id":     {"tv"},
+		"refresh_token": {"revoked"},
+	})
+	if status != http.StatusBadRequest || e.Error != "invalid_grant" || e.ErrorDescription != "The refresh token was revoked" {
+		t.Fatalf("Refresh of revoked token returned %d %+v, want the error of the provider", status, e)
+	}
+}
+
+func TestTokenRefreshWithoutRefreshToken(t *testing.T) {
+	setupRefreshEnv(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Provider called without a refresh token")
+	})
+
+	status, e := postToken(t, url.Values{
+		"grant_type": {GrantTypeRefreshToken},
+		"client_id":  {"tv"},
+	})
+	if status != http.StatusBadRequest || e.Error != "invalid_request" {
+		t.Fatalf("Refresh without refresh token returned %d %q, want 400 invalid_request", status, e.Error)
+	}
+}
@@ -6,10 +6,13 @@ import (
 
 	"github.com/charmixer/oas/api"
 
+	"github.com/wraix/device-flow-proxy/app"
 	"github.com/wraix/device-flow-proxy/endpoint"
 	"github.com/wraix/device-flow-proxy/endpoint/problem"
 
 	"go.opentelemetry.io/otel"
+
+	"github.com/rs/zerolog/log"
 )
 
 var (
@@ -51,7 +54,16 @@ func (ep GetHealthEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Ready: true,
 	}
 
+	// Not ready while the endpoints of a provider cannot be discovered
+	if err := app.Env.Providers.Ready(); err != nil {
+		log.Warn().Err(err).Msg("Not ready")
+		response.Ready = false
+	}
+
 	w.Header().Set("Content-Type", "application/json")
+	if !response.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
 
 	if err := endpoint.WithResponseValidation(ctx, response); err != nil {
 		problem.MustWrite(w, err)
@@ -0,0 +1,197 @@
+package keyring
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// KeySize is the size in bytes of every key encryption key, selecting AES-256.
+const KeySize = 32
+
+// sealedVersion prefixes every sealed value so the format can change later.
+const sealedVersion = "v1"
+
+var (
+	// ErrUnknownKey is returned when a value was sealed with a key no longer in the keyring.
+	ErrUnknownKey = errors.New("unknown key id")
+	// ErrMalformed is returned when a value was not sealed by a keyring.
+	ErrMalformed = errors.New("malformed sealed value")
+)
+
+// Keyring holds the key encryption keys used for envelope encryption. New values are
+// sealed with the primary key, while every key in the ring can still open values.
+type Keyring struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// File is the on disk format of a keyring, with keys as standard base64.
+//
+//	primary: "2021-11"
+//	keys:
+//	  "2021-11": "<base64 encoded 32 byte key>"
+//	  "2021-05": "<base64 encoded 32 byte key>"
+type File struct {
+	Primary string            `yaml:"primary"`
+	Keys    map[string]string `yaml:"keys"`
+}
+
+// New creates a keyring sealing with the key named primary.
+func New(primary string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("primary key %q is not in the keyring", primary)
+	}
+
+	k := &Keyring{
+		primary: primary,
+		keys:    map[string][]byte{},
+	}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ".") {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("key %q must be %d bytes, got %d", id, KeySize, len(key))
+		}
+		k.keys[id] = key
+	}
+	return k, nil
+}
+
+// Parse creates a keyring from base64 encoded keys.
+func Parse(file File) (*Keyring, error) {
+	keys := map[string][]byte{}
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q is not valid base64: %w", id, err)
+		}
+		keys[id] = key
+	}
+	return New(file.Primary, keys)
+}
+
+// Load reads a keyring file in yaml.
+func Load(path string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := File{}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return Parse(file)
+}
+
+// Ephemeral creates a keyring with a single random key, which is lost when the process exits.
+func Ephemeral() (*Keyring, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return New("ephemeral", map[string][]byte{"ephemeral": key})
+}
+
+// Seal encrypts plaintext with a fresh data key, which is in turn encrypted with the primary key.
+// The result is v1.<key id>.<wrapped data key>.<ciphertext>, and additionalData must be given again to open it.
+func (k *Keyring) Seal(plaintext []byte, additionalData []byte) (string, error) {
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := encrypt(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := encrypt(dataKey, plaintext, additionalData)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		sealedVersion,
+		k.primary,
+		base64.RawURLEncoding.EncodeToString(wrappedKey),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+	}, "."), nil
+}
+
+// Open decrypts a value sealed by Seal with any key still in the keyring.
+func (k *Keyring) Open(sealed string, additionalData []byte) ([]byte, error) {
+	parts := strings.Split(sealed, ".")
+	if len(parts) != 4 || parts[0] != sealedVersion {
+		return nil, ErrMalformed
+	}
+
+	key, ok := k.keys[parts[1]]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, parts[1])
+	}
+
+	wrappedKey, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	dataKey, err := decrypt(key, wrappedKey, []byte(parts[1]))
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(dataKey, ciphertext, additionalData)
+}
+
+// IsSealed tells if value looks like something returned by Seal.
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedVersion+".") && strings.Count(value, ".") == 3
+}
+
+// encrypt returns the random nonce followed by the AES-GCM ciphertext.
+func encrypt(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func decrypt(key []byte, data []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrMalformed
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
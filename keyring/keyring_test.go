@@ -0,0 +1,59 @@
+package keyring
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+func TestSealOpen(t *testing.T) {
+	k, err := New("one", map[string][]byte{"one": testKey(1)})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	sealed, err := k.Seal([]byte("secret"), []byte("field"))
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if !IsSealed(sealed) {
+		t.Fatalf("IsSealed(%q) is false", sealed)
+	}
+
+	plaintext, err := k.Open(sealed, []byte("field"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if string(plaintext) != "secret" {
+		t.Fatalf("Open returned %q, want secret", plaintext)
+	}
+
+	if _, err := k.Open(sealed, []byte("other field")); err == nil {
+		t.Fatalf("Open with other additional data succeeded")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old, _ := New("one", map[string][]byte{"one": testKey(1)})
+	sealed, err := old.Seal([]byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	rotated, err := New("two", map[string][]byte{"one": testKey(1), "two": testKey(2)})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if plaintext, err := rotated.Open(sealed, nil); err != nil || string(plaintext) != "secret" {
+		t.Fatalf("Open of value sealed before rotation returned %q, %v", plaintext, err)
+	}
+
+	retired, _ := New("two", map[string][]byte{"two": testKey(2)})
+	if _, err := retired.Open(sealed, nil); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Open with retired key returned %v, want ErrUnknownKey", err)
+	}
+}
@@ -0,0 +1,220 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrNotDiscovered is returned by Ready until the endpoints of a provider have been discovered.
+var ErrNotDiscovered = errors.New("provider: endpoints not discovered yet")
+
+// discoveryRetryInterval is how soon discovery is retried after failing, unless refreshing more often than that.
+const discoveryRetryInterval = 30 * time.Second
+
+// Endpoints of a provider, as named in https://datatracker.ietf.org/doc/html/rfc8414#section-2
+type Endpoints struct {
+	Authorization string `json:"authorization_endpoint" yaml:"authorization_endpoint"`
+	Token         string `json:"token_endpoint" yaml:"token_endpoint"`
+	Revocation    string `json:"revocation_endpoint,omitempty" yaml:"revocation_endpoint"`
+	Introspection string `json:"introspection_endpoint,omitempty" yaml:"introspection_endpoint"`
+	Userinfo      string `json:"userinfo_endpoint,omitempty" yaml:"userinfo_endpoint"`
+	JwksUri       string `json:"jwks_uri,omitempty" yaml:"jwks_uri"`
+}
+
+// override returns e with the endpoints set in o replacing those of e.
+func (e Endpoints) override(o Endpoints) Endpoints {
+	pick := func(a string, b string) string {
+		if b != "" {
+			return b
+		}
+		return a
+	}
+
+	return Endpoints{
+		Authorization: pick(e.Authorization, o.Authorization),
+		Token:         pick(e.Token, o.Token),
+		Revocation:    pick(e.Revocation, o.Revocation),
+		Introspection: pick(e.Introspection, o.Introspection),
+		Userinfo:      pick(e.Userinfo, o.Userinfo),
+		JwksUri:       pick(e.JwksUri, o.JwksUri),
+	}
+}
+
+type metadata struct {
+	Issuer string `json:"issuer"`
+	Endpoints
+	ScopesSupported []string `json:"scopes_supported"`
+}
+
+// Discover fetches the endpoints of the provider from the metadata of its issuer, see
+// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderConfig and https://datatracker.ietf.org/doc/html/rfc8414#section-3
+// The endpoints discovered last are kept when discovery fails.
+func (p *Provider) Discover(ctx context.Context) error {
+	m, err := p.fetchMetadata(ctx)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.discoveryErr = err
+	if err == nil {
+		p.discovered = m.Endpoints
+		p.scopesSupported = m.ScopesSupported
+		p.discoveredAt = time.Now()
+	}
+	return err
+}
+
+// ScopesSupported returns the scopes the provider published in its metadata, if any.
+func (p *Provider) ScopesSupported() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.scopesSupported
+}
+
+// Ready tells if the endpoints of the provider are known, and the latest discovery succeeded.
+func (p *Provider) Ready() error {
+	if p.Issuer == "" {
+		return nil
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.discoveryErr != nil {
+		return p.discoveryErr
+	}
+	if p.discoveredAt.IsZero() {
+		return ErrNotDiscovered
+	}
+	return nil
+}
+
+func (p *Provider) fetchMetadata(ctx context.Context) (metadata, error) {
+	locations, err := wellKnownLocations(p.Issuer)
+	if err != nil {
+		return metadata{}, err
+	}
+
+	for _, location := range locations {
+		m, found, err := p.fetch(ctx, location)
+		if err != nil {
+			return metadata{}, err
+		}
+		if !found {
+			continue
+		}
+
+		// See https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderConfigurationValidation
+		if m.Issuer != p.Issuer {
+			return metadata{}, fmt.Errorf("provider %s: metadata at %s is for issuer %s", p.Name, location, m.Issuer)
+		}
+		endpoints := m.Endpoints.override(p.Endpoints)
+		if endpoints.Authorization == "" || endpoints.Token == "" {
+			return metadata{}, fmt.Errorf("provider %s: metadata at %s has no authorization or token endpoint", p.Name, location)
+		}
+		return m, nil
+	}
+
+	return metadata{}, fmt.Errorf("provider %s: no metadata found for issuer %s", p.Name, p.Issuer)
+}
+
+func (p *Provider) fetch(ctx context.Context, location string) (m metadata, found bool, err error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return metadata{}, false, err
+	}
+	request.Header.Set("Accept", "application/json")
+
+	response, err := p.HTTPClient.Do(request)
+	if err != nil {
+		return metadata{}, false, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return metadata{}, false, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return metadata{}, false, fmt.Errorf("provider %s: %s returned %s", p.Name, location, response.Status)
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&m); err != nil {
+		return metadata{}, false, fmt.Errorf("provider %s: invalid metadata at %s: %w", p.Name, location, err)
+	}
+	return m, true, nil
+}
+
+// wellKnownLocations are where the metadata of an issuer may be published, OpenID Connect discovery first
+func wellKnownLocations(issuer string) ([]string, error) {
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("issuer %s is not an absolute url", issuer)
+	}
+
+	path := strings.TrimSuffix(u.Path, "/")
+	return []string{
+		strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration",
+		// RFC 8414 puts the well-known path in front of the path of the issuer, see https://datatracker.ietf.org/doc/html/rfc8414#section-3.1
+		u.Scheme + "://" + u.Host + "/.well-known/oauth-authorization-server" + path,
+	}, nil
+}
+
+// Ready tells if every provider is ready to sign users in.
+func (r *Registry) Ready() error {
+	for _, p := range r.All() {
+		if err := p.Ready(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartDiscovery discovers the endpoints of every provider with an issuer, and keeps refreshing them at the given interval
+// until the returned function is called.
+func (r *Registry) StartDiscovery(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	for _, p := range r.All() {
+		if p.Issuer == "" {
+			continue
+		}
+
+		p := p
+		discover := func() time.Duration {
+			if err := p.Discover(ctx); err != nil {
+				log.Error().Err(err).Str("provider", p.Name).Str("issuer", p.Issuer).Msg("Unable to discover provider endpoints")
+				if discoveryRetryInterval < interval {
+					return discoveryRetryInterval
+				}
+				return interval
+			}
+
+			log.Debug().Str("provider", p.Name).Str("issuer", p.Issuer).Msg("Discovered provider endpoints")
+			return interval
+		}
+
+		// Discover once before serving, so requests do not fail while waiting for the first refresh
+		next := discover()
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(next):
+					next = discover()
+				}
+			}
+		}()
+	}
+
+	return cancel
+}
@@ -0,0 +1,86 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDiscover(t *testing.T) {
+	var server *httptest.Server
+	issuer := ""
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only publishes RFC 8414 metadata for an issuer with a path
+		if r.URL.Path != "/.well-known/oauth-authorization-server/tenant" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": server.URL + "/tenant/auth",
+			"token_endpoint":         server.URL + "/tenant/token",
+			"revocation_endpoint":    server.URL + "/tenant/revoke",
+			"jwks_uri":               server.URL + "/tenant/jwks",
+		})
+	}))
+	defer server.Close()
+	issuer = server.URL + "/tenant"
+
+	p := &Provider{
+		Name:       "tenant",
+		Issuer:     issuer,
+		Endpoints:  Endpoints{Token: "http://internal/token"},
+		HTTPClient: server.Client(),
+	}
+	if err := p.Ready(); !errors.Is(err, ErrNotDiscovered) {
+		t.Fatalf("Ready before discovery returned %v, want ErrNotDiscovered", err)
+	}
+
+	if err := p.Discover(context.Background()); err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	if err := p.Ready(); err != nil {
+		t.Fatalf("Ready: %v", err)
+	}
+
+	endpoints := p.Current()
+	if endpoints.Authorization != server.URL+"/tenant/auth" || endpoints.Revocation != server.URL+"/tenant/revoke" || endpoints.JwksUri != server.URL+"/tenant/jwks" {
+		t.Fatalf("Current returned %+v", endpoints)
+	}
+	if endpoints.Token != "http://internal/token" {
+		t.Fatalf("configured token endpoint replaced by %s", endpoints.Token)
+	}
+
+	// Metadata of another issuer must not be used, and readiness fails while the last endpoints are kept
+	issuer = "https://attacker"
+	if err := p.Discover(context.Background()); err == nil {
+		t.Fatalf("Discover accepted metadata of another issuer")
+	}
+	if err := p.Ready(); err == nil {
+		t.Fatalf("Ready after failed discovery returned nil")
+	}
+	if p.Current().Authorization != server.URL+"/tenant/auth" {
+		t.Fatalf("endpoints lost after failed discovery")
+	}
+}
+
+func TestWellKnownLocations(t *testing.T) {
+	locations, err := wellKnownLocations("https://example.com/realms/devices/")
+	if err != nil {
+		t.Fatalf("wellKnownLocations: %v", err)
+	}
+	want := []string{
+		"https://example.com/realms/devices/.well-known/openid-configuration",
+		"https://example.com/.well-known/oauth-authorization-server/realms/devices",
+	}
+	if len(locations) != len(want) || locations[0] != want[0] || locations[1] != want[1] {
+		t.Fatalf("wellKnownLocations returned %v, want %v", locations, want)
+	}
+
+	if _, err := wellKnownLocations("example.com"); err == nil {
+		t.Fatalf("wellKnownLocations accepted a relative issuer")
+	}
+}
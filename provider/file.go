@@ -0,0 +1,120 @@
+package provider
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/wraix/device-flow-proxy/client"
+)
+
+// File is the yaml representation of a provider registry.
+//
+//	default: hydra
+//	providers:
+//	  - name: hydra
+//	    issuer: https://hydra.example.com/
+//	  - name: keycloak
+//	    authorization_endpoint: https://keycloak.example.com/realms/devices/protocol/openid-connect/auth
+//	    token_endpoint: https://keycloak.example.com/realms/devices/protocol/openid-connect/token
+//	    client_id: device-flow-proxy
+//	    client_secret: 5e4f8a0c2b1d
+//	    token_endpoint_auth_method: client_secret_post
+//	    tls:
+//	      ca_file: /etc/device-flow-proxy/keycloak-ca.pem
+type File struct {
+	Default   string         `yaml:"default"`
+	Providers []FileProvider `yaml:"providers"`
+}
+
+// FileProvider is a provider in a File.
+type FileProvider struct {
+	Name string `yaml:"name"`
+	// Issuer is where the endpoints are discovered, endpoints given in the file take precedence over discovered ones.
+	Issuer    string    `yaml:"issuer"`
+	Endpoints Endpoints `yaml:",inline"`
+	// ClientId is the client the proxy signs users in as, device clients sign in as themselves when left out.
+	ClientId     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// AuthMethod is how the proxy authenticates as ClientId, client_secret_basic by default when a secret is given.
+	AuthMethod string `yaml:"token_endpoint_auth_method"`
+	TLS        TLS    `yaml:"tls"`
+}
+
+// Parse creates a registry of the providers in file. The default provider may be left out when only one is listed.
+func Parse(file File) (*Registry, error) {
+	defaultName := file.Default
+	if defaultName == "" && len(file.Providers) == 1 {
+		defaultName = file.Providers[0].Name
+	}
+
+	providers := []*Provider{}
+	for _, fp := range file.Providers {
+		upstream, err := parseClient(fp)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", fp.Name, err)
+		}
+
+		config, err := fp.TLS.Config()
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %w", fp.Name, err)
+		}
+
+		providers = append(providers, &Provider{
+			Name:       fp.Name,
+			Issuer:     fp.Issuer,
+			Endpoints:  fp.Endpoints,
+			Client:     upstream,
+			HTTPClient: NewHTTPClient(config),
+		})
+	}
+
+	return NewRegistry(defaultName, providers...)
+}
+
+func parseClient(fp FileProvider) (client.Client, error) {
+	if fp.ClientId == "" {
+		if fp.ClientSecret != "" || fp.AuthMethod != "" {
+			return client.Client{}, fmt.Errorf("client_secret and token_endpoint_auth_method need a client_id")
+		}
+		return client.Client{}, nil
+	}
+
+	method := fp.AuthMethod
+	if method == "" {
+		method = client.AuthMethodNone
+		if fp.ClientSecret != "" {
+			method = client.AuthMethodClientSecretBasic
+		}
+	}
+
+	switch method {
+	case client.AuthMethodNone:
+		if fp.ClientSecret != "" {
+			return client.Client{}, fmt.Errorf("public clients have no secret")
+		}
+	case client.AuthMethodClientSecretBasic, client.AuthMethodClientSecretPost:
+		if fp.ClientSecret == "" {
+			return client.Client{}, fmt.Errorf("%s needs a client_secret", method)
+		}
+	default:
+		return client.Client{}, fmt.Errorf("unsupported token_endpoint_auth_method %s", method)
+	}
+
+	return client.Client{Id: fp.ClientId, Secret: fp.ClientSecret, AuthMethod: method}, nil
+}
+
+// Load reads a registry from a yaml File.
+func Load(path string) (*Registry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := File{}
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+	return Parse(file)
+}
@@ -0,0 +1,78 @@
+package provider
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/contrib/propagators/jaeger"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// TLS are the settings for connecting to a provider.
+type TLS struct {
+	// InsecureSkipVerify accepts any certificate presented by the provider.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+	// CAFile is a pem file with the certificates the provider certificate must be signed by, instead of the system pool.
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile is a pem encoded client certificate presented to the provider.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// Config builds the tls configuration of the settings.
+func (t TLS) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", t.CAFile)
+		}
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+type tracingTransport struct {
+	originalTransport http.RoundTripper
+}
+
+func (c *tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// Convert from OTEL to Jaeger trace context
+	prop := jaeger.Jaeger{}
+	prop.Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	return c.originalTransport.RoundTrip(r)
+}
+
+// NewHTTPClient creates a traced http client connecting with the given tls configuration.
+func NewHTTPClient(config *tls.Config) *http.Client {
+	timeout := time.Duration(5 * time.Second)
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &tracingTransport{
+			originalTransport: otelhttp.NewTransport(&http.Transport{
+				TLSClientConfig: config,
+			}),
+		},
+	}
+}
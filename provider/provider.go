@@ -0,0 +1,135 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wraix/device-flow-proxy/client"
+)
+
+// ErrUnknownProvider is returned for provider names not in the registry.
+var ErrUnknownProvider = errors.New("provider: unknown provider")
+
+// RedirectPath is where the default provider redirects users back to the proxy. Other providers redirect
+// to RedirectPath followed by their name.
+const RedirectPath = "/auth/redirect"
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Provider is an upstream OAuth2 Provider users sign in with using the authorization code grant.
+type Provider struct {
+	Name string
+	// Issuer is where the endpoints of the provider are discovered, see Discover.
+	Issuer string
+	// Endpoints are the configured endpoints, which take precedence over discovered endpoints.
+	Endpoints Endpoints
+	// Client is the client the proxy signs users in as. Device clients sign in as themselves when it has no Id.
+	Client client.Client
+	// HTTPClient calls the provider with its TLS settings.
+	HTTPClient *http.Client
+
+	redirectPath string
+
+	mutex           sync.RWMutex
+	discovered      Endpoints
+	scopesSupported []string
+	discoveredAt    time.Time
+	discoveryErr    error
+}
+
+// Current returns the endpoints of the provider, as configured or else as discovered.
+func (p *Provider) Current() Endpoints {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.discovered.override(p.Endpoints)
+}
+
+// RedirectPath is the path of the proxy the provider redirects users back to after signing in.
+func (p *Provider) RedirectPath() string {
+	return p.redirectPath
+}
+
+// UpstreamClient is the client the user signs in with for the given device client.
+func (p *Provider) UpstreamClient(device client.Client) client.Client {
+	if p.Client.Id != "" {
+		return p.Client
+	}
+	return device
+}
+
+// Registry holds every configured provider.
+type Registry struct {
+	defaultName string
+	providers   map[string]*Provider
+}
+
+// NewRegistry creates a registry of the given providers, routing flows without a provider to the one named defaultName.
+func NewRegistry(defaultName string, providers ...*Provider) (*Registry, error) {
+	r := &Registry{
+		defaultName: defaultName,
+		providers:   map[string]*Provider{},
+	}
+
+	for _, p := range providers {
+		if !validName.MatchString(p.Name) {
+			return nil, fmt.Errorf("provider %q: names may only contain letters, digits, - and _", p.Name)
+		}
+		if _, ok := r.providers[p.Name]; ok {
+			return nil, fmt.Errorf("provider %s: listed more than once", p.Name)
+		}
+		if p.Issuer == "" && (p.Endpoints.Authorization == "" || p.Endpoints.Token == "") {
+			return nil, fmt.Errorf("provider %s: an issuer or the authorization and token endpoints are required", p.Name)
+		}
+		if p.HTTPClient == nil {
+			p.HTTPClient = NewHTTPClient(nil)
+		}
+
+		// The default provider keeps the redirect path used before providers could be named, so registered callbacks keep working
+		p.redirectPath = RedirectPath + "/" + p.Name
+		if p.Name == defaultName {
+			p.redirectPath = RedirectPath
+		}
+
+		r.providers[p.Name] = p
+	}
+
+	if _, ok := r.providers[defaultName]; !ok {
+		return nil, fmt.Errorf("provider: default provider %s is not configured", defaultName)
+	}
+	return r, nil
+}
+
+// Get returns the provider with the given name, or the default provider when name is empty.
+func (r *Registry) Get(name string) (*Provider, error) {
+	if name == "" {
+		name = r.defaultName
+	}
+
+	p, ok := r.providers[name]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return p, nil
+}
+
+// Default returns the provider flows are routed to unless the client or device asks for another.
+func (r *Registry) Default() *Provider {
+	return r.providers[r.defaultName]
+}
+
+// All returns every provider ordered by name.
+func (r *Registry) All() []*Provider {
+	providers := []*Provider{}
+	for _, p := range r.providers {
+		providers = append(providers, p)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name < providers[j].Name
+	})
+	return providers
+}
@@ -0,0 +1,86 @@
+package provider
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/wraix/device-flow-proxy/client"
+)
+
+func TestParse(t *testing.T) {
+	r, err := Parse(File{
+		Default: "hydra",
+		Providers: []FileProvider{{
+			Name:      "hydra",
+			Endpoints: Endpoints{Authorization: "https://hydra/oauth2/auth", Token: "https://hydra/oauth2/token"},
+		}, {
+			Name:         "keycloak",
+			Endpoints:    Endpoints{Authorization: "https://keycloak/auth", Token: "https://keycloak/token"},
+			ClientId:     "proxy",
+			ClientSecret: "secret",
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	hydra, err := r.Get("")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if hydra.Name != "hydra" || hydra.RedirectPath() != "/auth/redirect" || hydra != r.Default() {
+		t.Fatalf("Get of the default provider returned %s with redirect path %s", hydra.Name, hydra.RedirectPath())
+	}
+
+	keycloak, err := r.Get("keycloak")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if keycloak.RedirectPath() != "/auth/redirect/keycloak" {
+		t.Fatalf("redirect path of keycloak is %s", keycloak.RedirectPath())
+	}
+	if keycloak.Client.AuthMethod != client.AuthMethodClientSecretBasic {
+		t.Fatalf("client with a secret got auth method %s", keycloak.Client.AuthMethod)
+	}
+
+	device := client.Client{Id: "tv"}
+	if got := hydra.UpstreamClient(device); got.Id != "tv" {
+		t.Fatalf("provider without client signs in as %s, want the device client", got.Id)
+	}
+	if got := keycloak.UpstreamClient(device); got.Id != "proxy" {
+		t.Fatalf("provider with client signs in as %s, want proxy", got.Id)
+	}
+
+	if _, err := r.Get("github"); !errors.Is(err, ErrUnknownProvider) {
+		t.Fatalf("Get of unknown provider returned %v, want ErrUnknownProvider", err)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	valid := FileProvider{Name: "hydra", Endpoints: Endpoints{Authorization: "https://hydra/auth", Token: "https://hydra/token"}}
+
+	withName := valid
+	withName.Name = "hydra/2"
+	withoutEndpoint := valid
+	withoutEndpoint.Endpoints.Token = ""
+	secretWithoutClient := valid
+	secretWithoutClient.ClientSecret = "secret"
+	postWithoutSecret := valid
+	postWithoutSecret.ClientId = "proxy"
+	postWithoutSecret.AuthMethod = client.AuthMethodClientSecretPost
+
+	files := map[string]File{
+		"invalid name":             {Providers: []FileProvider{withName}},
+		"missing endpoint":         {Providers: []FileProvider{withoutEndpoint}},
+		"secret without client_id": {Providers: []FileProvider{secretWithoutClient}},
+		"post without secret":      {Providers: []FileProvider{postWithoutSecret}},
+		"listed twice":             {Default: "hydra", Providers: []FileProvider{valid, valid}},
+		"unknown default":          {Default: "github", Providers: []FileProvider{valid}},
+		"no default":               {Providers: []FileProvider{valid, {Name: "other", Endpoints: Endpoints{Authorization: "a", Token: "b"}}}},
+	}
+	for name, file := range files {
+		if _, err := Parse(file); err == nil {
+			t.Errorf("Parse accepted %s", name)
+		}
+	}
+}
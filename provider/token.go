@@ -0,0 +1,52 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/wraix/device-flow-proxy/client"
+)
+
+// Token calls the token endpoint of the provider as client c with the given parameters, see
+// https://datatracker.ietf.org/doc/html/rfc6749#section-3.2
+// The status and body of the response are returned whether the provider issued a token or returned an error.
+func (p *Provider) Token(ctx context.Context, c client.Client, params url.Values) (status int, body []byte, err error) {
+	tokenEndpoint := p.Current().Token
+	if tokenEndpoint == "" {
+		return 0, nil, ErrNotDiscovered
+	}
+
+	q := url.Values{}
+	for key, values := range params {
+		q[key] = values
+	}
+	q.Set("client_id", c.Id)
+	if c.AuthMethod == client.AuthMethodClientSecretPost {
+		q.Set("client_secret", c.Secret)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", tokenEndpoint, bytes.NewBufferString(q.Encode()))
+	if err != nil {
+		return 0, nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if c.AuthMethod == client.AuthMethodClientSecretBasic {
+		// See https://datatracker.ietf.org/doc/html/rfc6749#section-2.3.1
+		request.SetBasicAuth(url.QueryEscape(c.Id), url.QueryEscape(c.Secret))
+	}
+
+	response, err := p.HTTPClient.Do(request)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer response.Body.Close()
+
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return response.StatusCode, body, nil
+}
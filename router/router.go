@@ -67,14 +67,20 @@ func NewRouter(name string, description string, version string) *Router {
 
 	r.NewRoute("GET", "/metrics", metrics.NewGetMetricsEndpoint())
 
+	// Authorization server metadata, see https://datatracker.ietf.org/doc/html/rfc8414#section-3
+	r.NewRoute("GET", "/.well-known/oauth-authorization-server", device.NewGetMetadataEndpoint())
+
 	// Device API
 	r.NewRoute("POST", "/device/code", device.NewPostCodeEndpoint())
 	r.NewRoute("POST", "/device/token", device.NewPostTokenEndpoint())
+	r.NewRoute("GET", "/device/qr", device.NewGetQrEndpoint())
 
 	// Browser routes
 	r.NewRoute("GET", "/device", browser.NewGetDeviceEndpoint())
 	r.NewRoute("GET", "/auth/verify_code", browser.NewGetVerifyCodeEndpoint())
+	r.NewRoute("POST", "/auth/consent", browser.NewPostConsentEndpoint())
 	r.NewRoute("GET", "/auth/redirect", browser.NewGetRedirectEndpoint())
+	r.NewRoute("GET", "/auth/redirect/:provider", browser.NewGetRedirectEndpoint())
 
 	return r
 }
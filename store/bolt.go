@@ -0,0 +1,348 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	flowsBucket     = []byte("flows")
+	userCodesBucket = []byte("user_codes")
+	statesBucket    = []byte("states")
+	attemptsBucket  = []byte("attempts")
+)
+
+// boltEntry wraps everything written to bolt with an expiry, as bolt has no native TTL.
+type boltEntry struct {
+	ExpiresAt  time.Time `json:"expires_at"`
+	Flow       *Flow     `json:"flow,omitempty"`
+	DeviceCode string    `json:"device_code,omitempty"`
+	Attempts   *Attempts `json:"attempts,omitempty"`
+}
+
+func (e boltEntry) expired(now time.Time) bool {
+	return !e.ExpiresAt.After(now)
+}
+
+// BoltStore keeps flows in an embedded bolt database file, so they survive restarts
+// of single node deployments. Every write is a fsynced transaction.
+type BoltStore struct {
+	db   *bolt.DB
+	done chan struct{}
+}
+
+// NewBoltStore opens or creates the database at path and purges expired entries every purgeInterval.
+func NewBoltStore(path string, purgeInterval time.Duration) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{flowsBucket, userCodesBucket, statesBucket, attemptsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &BoltStore{
+		db:   db,
+		done: make(chan struct{}),
+	}
+	go s.purgeExpired(purgeInterval)
+
+	return s, nil
+}
+
+// Close stops the purging of expired entries and closes the database.
+func (s *BoltStore) Close() error {
+	close(s.done)
+	return s.db.Close()
+}
+
+func (s *BoltStore) CreatePendingFlow(ctx context.Context, flow Flow, ttl time.Duration) error {
+	flow.Status = StatusPending
+	expiresAt := time.Now().Add(ttl)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		_, err := get(tx, userCodesBucket, flow.UserCode)
+		if err == nil {
+			return ErrUserCodeTaken
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		if err := put(tx, flowsBucket, flow.DeviceCode, boltEntry{ExpiresAt: expiresAt, Flow: &flow}); err != nil {
+			return err
+		}
+		return put(tx, userCodesBucket, flow.UserCode, boltEntry{ExpiresAt: expiresAt, DeviceCode: flow.DeviceCode})
+	})
+}
+
+func (s *BoltStore) GetByUserCode(ctx context.Context, userCode string) (flow *Flow, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		flow, err = getIndexed(tx, userCodesBucket, userCode)
+		return err
+	})
+	return flow, err
+}
+
+func (s *BoltStore) GetByDeviceCode(ctx context.Context, deviceCode string) (flow *Flow, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		entry, err := get(tx, flowsBucket, deviceCode)
+		if err != nil {
+			return err
+		}
+		flow = entry.Flow
+		return nil
+	})
+	return flow, err
+}
+
+func (s *BoltStore) BindState(ctx context.Context, state string, deviceCode string, ttl time.Duration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := get(tx, flowsBucket, deviceCode); err != nil {
+			return err
+		}
+		return put(tx, statesBucket, state, boltEntry{ExpiresAt: time.Now().Add(ttl), DeviceCode: deviceCode})
+	})
+}
+
+func (s *BoltStore) GetByState(ctx context.Context, state string) (flow *Flow, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		flow, err = getIndexed(tx, statesBucket, state)
+		return err
+	})
+	return flow, err
+}
+
+func (s *BoltStore) Approve(ctx context.Context, deviceCode string, session string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		entry, err := get(tx, flowsBucket, deviceCode)
+		if err != nil {
+			return err
+		}
+		if entry.Flow.Status != StatusPending {
+			return ErrNotFound
+		}
+		entry.Flow.ApprovedBy = session
+
+		return put(tx, flowsBucket, deviceCode, entry)
+	})
+}
+
+func (s *BoltStore) Complete(ctx context.Context, deviceCode string, tokenResponse string, ttl time.Duration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		entry, err := get(tx, flowsBucket, deviceCode)
+		if err != nil {
+			return err
+		}
+		if entry.Flow.Status != StatusPending {
+			return ErrNotFound
+		}
+		entry.Flow.Status = StatusComplete
+		entry.Flow.TokenResponse = tokenResponse
+		entry.ExpiresAt = time.Now().Add(ttl)
+
+		if err := put(tx, flowsBucket, deviceCode, entry); err != nil {
+			return err
+		}
+		return tx.Bucket(userCodesBucket).Delete([]byte(entry.Flow.UserCode))
+	})
+}
+
+func (s *BoltStore) Poll(ctx context.Context, deviceCode string, at time.Time) (result PollResult, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		entry, err := get(tx, flowsBucket, deviceCode)
+		if err != nil {
+			return err
+		}
+		result = entry.Flow.registerPoll(at)
+
+		return put(tx, flowsBucket, deviceCode, entry)
+	})
+	return result, err
+}
+
+func (s *BoltStore) Deny(ctx context.Context, deviceCode string, description string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		entry, err := get(tx, flowsBucket, deviceCode)
+		if err != nil {
+			return err
+		}
+		entry.Flow.Status = StatusDenied
+		entry.Flow.ErrorDescription = description
+
+		if err := put(tx, flowsBucket, deviceCode, entry); err != nil {
+			return err
+		}
+		return tx.Bucket(userCodesBucket).Delete([]byte(entry.Flow.UserCode))
+	})
+}
+
+func (s *BoltStore) Redeem(ctx context.Context, deviceCode string) (flow *Flow, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		entry, err := get(tx, flowsBucket, deviceCode)
+		if err != nil {
+			return err
+		}
+		if entry.Flow.Status != StatusComplete {
+			return ErrNotFound
+		}
+		flow = entry.Flow
+
+		if err := tx.Bucket(userCodesBucket).Delete([]byte(flow.UserCode)); err != nil {
+			return err
+		}
+		return tx.Bucket(flowsBucket).Delete([]byte(deviceCode))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return flow, nil
+}
+
+func (s *BoltStore) Delete(ctx context.Context, deviceCode string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if entry, err := get(tx, flowsBucket, deviceCode); err == nil {
+			if err := tx.Bucket(userCodesBucket).Delete([]byte(entry.Flow.UserCode)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(flowsBucket).Delete([]byte(deviceCode))
+	})
+}
+
+func (s *BoltStore) ReserveAttempt(ctx context.Context, key string, at time.Time, ttl time.Duration) (previous Attempts, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		entry, err := get(tx, attemptsBucket, key)
+		if err == nil {
+			previous = *entry.Attempts
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		attempts := Attempts{Failures: previous.Failures + 1, LastFailedAt: at}
+		return put(tx, attemptsBucket, key, boltEntry{ExpiresAt: at.Add(ttl), Attempts: &attempts})
+	})
+	return previous, err
+}
+
+func (s *BoltStore) RefundAttempt(ctx context.Context, key string, at time.Time, previous Attempts) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		entry, err := get(tx, attemptsBucket, key)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if entry.Attempts.Failures > 0 {
+			entry.Attempts.Failures--
+		}
+		if entry.Attempts.LastFailedAt.Equal(at) {
+			entry.Attempts.LastFailedAt = previous.LastFailedAt
+		}
+		return put(tx, attemptsBucket, key, entry)
+	})
+}
+
+func (s *BoltStore) GetAttempts(ctx context.Context, key string) (attempts Attempts, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		entry, err := get(tx, attemptsBucket, key)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		attempts = *entry.Attempts
+		return nil
+	})
+	return attempts, err
+}
+
+// purgeExpired removes expired entries every interval until the store is closed, like go-cache's janitor.
+func (s *BoltStore) purgeExpired(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.purge(time.Now()); err != nil {
+				log.Error().Err(err).Msg("Unable to purge expired device flows")
+			}
+		}
+	}
+}
+
+func (s *BoltStore) purge(now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{flowsBucket, userCodesBucket, statesBucket, attemptsBucket} {
+			c := tx.Bucket(b).Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				entry := boltEntry{}
+				if err := json.Unmarshal(v, &entry); err != nil || entry.expired(now) {
+					if err := c.Delete(); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func put(tx *bolt.Tx, bucket []byte, key string, entry boltEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put([]byte(key), data)
+}
+
+// get returns the entry for key, treating entries not yet purged as missing once expired.
+func get(tx *bolt.Tx, bucket []byte, key string) (boltEntry, error) {
+	entry := boltEntry{}
+
+	data := tx.Bucket(bucket).Get([]byte(key))
+	if data == nil {
+		return entry, ErrNotFound
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, err
+	}
+	if entry.expired(time.Now()) {
+		return entry, ErrNotFound
+	}
+	return entry, nil
+}
+
+// getIndexed follows an index entry, like a user code or state, to the flow it points at.
+func getIndexed(tx *bolt.Tx, bucket []byte, key string) (*Flow, error) {
+	index, err := get(tx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := get(tx, flowsBucket, index.DeviceCode)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Flow, nil
+}
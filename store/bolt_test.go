@@ -0,0 +1,69 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestBoltStore(t *testing.T, path string) *BoltStore {
+	s, err := NewBoltStore(path, time.Minute)
+	if err != nil {
+		t.Fatalf("NewBoltStore: %v", err)
+	}
+	return s
+}
+
+func TestBoltStore(t *testing.T) {
+	s := newTestBoltStore(t, filepath.Join(t.TempDir(), "flows.db"))
+	defer s.Close()
+
+	testFlowStore(t, s)
+}
+
+func TestBoltStoreSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "flows.db")
+
+	s := newTestBoltStore(t, path)
+	if err := s.CreatePendingFlow(ctx, Flow{DeviceCode: "device-code", UserCode: "USERCODE"}, time.Minute); err != nil {
+		t.Fatalf("CreatePendingFlow: %v", err)
+	}
+	s.Close()
+
+	s = newTestBoltStore(t, path)
+	defer s.Close()
+
+	if _, err := s.GetByUserCode(ctx, "USERCODE"); err != nil {
+		t.Fatalf("GetByUserCode after reopen: %v", err)
+	}
+}
+
+func TestBoltStorePurge(t *testing.T) {
+	ctx := context.Background()
+	s := newTestBoltStore(t, filepath.Join(t.TempDir(), "flows.db"))
+	defer s.Close()
+
+	if err := s.CreatePendingFlow(ctx, Flow{DeviceCode: "device-code", UserCode: "USERCODE"}, time.Minute); err != nil {
+		t.Fatalf("CreatePendingFlow: %v", err)
+	}
+
+	if err := s.purge(time.Now().Add(2 * time.Minute)); err != nil {
+		t.Fatalf("purge: %v", err)
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{flowsBucket, userCodesBucket} {
+			if n := tx.Bucket(b).Stats().KeyN; n != 0 {
+				t.Errorf("bucket %s has %d keys after purge, want 0", b, n)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+}
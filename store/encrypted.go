@@ -0,0 +1,109 @@
+package store
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Cipher seals and opens sensitive values, see keyring.Keyring.
+type Cipher interface {
+	Seal(plaintext []byte, additionalData []byte) (string, error)
+	Open(sealed string, additionalData []byte) ([]byte, error)
+}
+
+// Field names are used as additional data, so a sealed value cannot be moved to another field.
+var (
+	pkceVerifierField  = []byte("pkce_verifier")
+	tokenResponseField = []byte("token_response")
+)
+
+// additionalData binds a sealed value to both its field and the flow, identified by the device code as stored,
+// so it cannot be moved to another flow either.
+func additionalData(field []byte, deviceCode string) []byte {
+	data := append([]byte{}, field...)
+	data = append(data, 0)
+	return append(data, deviceCode...)
+}
+
+// EncryptedStore seals PKCE verifiers and token responses before they reach the wrapped store,
+// and opens them again on the way out.
+type EncryptedStore struct {
+	FlowStore
+	cipher Cipher
+}
+
+// NewEncryptedStore wraps s, encrypting sensitive fields with cipher.
+func NewEncryptedStore(s FlowStore, cipher Cipher) *EncryptedStore {
+	return &EncryptedStore{
+		FlowStore: s,
+		cipher:    cipher,
+	}
+}
+
+func (s *EncryptedStore) CreatePendingFlow(ctx context.Context, flow Flow, ttl time.Duration) error {
+	sealed, err := s.cipher.Seal([]byte(flow.PkceVerifier), additionalData(pkceVerifierField, flow.DeviceCode))
+	if err != nil {
+		return err
+	}
+	flow.PkceVerifier = sealed
+
+	return s.FlowStore.CreatePendingFlow(ctx, flow, ttl)
+}
+
+func (s *EncryptedStore) GetByUserCode(ctx context.Context, userCode string) (*Flow, error) {
+	return s.open(s.FlowStore.GetByUserCode(ctx, userCode))
+}
+
+func (s *EncryptedStore) GetByDeviceCode(ctx context.Context, deviceCode string) (*Flow, error) {
+	return s.open(s.FlowStore.GetByDeviceCode(ctx, deviceCode))
+}
+
+func (s *EncryptedStore) GetByState(ctx context.Context, state string) (*Flow, error) {
+	return s.open(s.FlowStore.GetByState(ctx, state))
+}
+
+func (s *EncryptedStore) Complete(ctx context.Context, deviceCode string, tokenResponse string, ttl time.Duration) error {
+	sealed, err := s.cipher.Seal([]byte(tokenResponse), additionalData(tokenResponseField, deviceCode))
+	if err != nil {
+		return err
+	}
+
+	return s.FlowStore.Complete(ctx, deviceCode, sealed, ttl)
+}
+
+func (s *EncryptedStore) Redeem(ctx context.Context, deviceCode string) (*Flow, error) {
+	return s.open(s.FlowStore.Redeem(ctx, deviceCode))
+}
+
+func (s *EncryptedStore) open(flow *Flow, err error) (*Flow, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	if flow.PkceVerifier != "" {
+		pkceVerifier, err := s.cipher.Open(flow.PkceVerifier, additionalData(pkceVerifierField, flow.DeviceCode))
+		if err != nil {
+			return nil, err
+		}
+		flow.PkceVerifier = string(pkceVerifier)
+	}
+
+	if flow.TokenResponse != "" {
+		tokenResponse, err := s.cipher.Open(flow.TokenResponse, additionalData(tokenResponseField, flow.DeviceCode))
+		if err != nil {
+			return nil, err
+		}
+		flow.TokenResponse = string(tokenResponse)
+	}
+
+	return flow, nil
+}
+
+// Close closes the wrapped store if it holds any resources.
+func (s *EncryptedStore) Close() error {
+	if closer, ok := s.FlowStore.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+// MinHashKeySize is the fewest bytes a hash key may have, the size of the HMAC-SHA256 output.
+const MinHashKeySize = sha256.Size
+
+// HashedStore keys the wrapped store by a HMAC of device codes, user codes and states instead of
+// the codes themselves, so a dump of the store is not enough to redeem tokens or hijack a pending flow.
+// Failed attempts are counted by the HMAC of their key too, so the store does not reveal who entered codes.
+//
+// Flows returned hold the hashed codes, which is what mutations expect as DeviceCode.
+type HashedStore struct {
+	FlowStore
+	key []byte
+}
+
+// NewHashedStore wraps s, hashing every code presented to it with key.
+func NewHashedStore(s FlowStore, key []byte) *HashedStore {
+	return &HashedStore{
+		FlowStore: s,
+		key:       key,
+	}
+}
+
+func (s *HashedStore) hash(code string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *HashedStore) CreatePendingFlow(ctx context.Context, flow Flow, ttl time.Duration) error {
+	flow.DeviceCode = s.hash(flow.DeviceCode)
+	flow.UserCode = s.hash(flow.UserCode)
+	return s.FlowStore.CreatePendingFlow(ctx, flow, ttl)
+}
+
+func (s *HashedStore) GetByUserCode(ctx context.Context, userCode string) (*Flow, error) {
+	return s.FlowStore.GetByUserCode(ctx, s.hash(userCode))
+}
+
+func (s *HashedStore) GetByDeviceCode(ctx context.Context, deviceCode string) (*Flow, error) {
+	return s.FlowStore.GetByDeviceCode(ctx, s.hash(deviceCode))
+}
+
+func (s *HashedStore) BindState(ctx context.Context, state string, deviceCode string, ttl time.Duration) error {
+	return s.FlowStore.BindState(ctx, s.hash(state), deviceCode, ttl)
+}
+
+func (s *HashedStore) GetByState(ctx context.Context, state string) (*Flow, error) {
+	return s.FlowStore.GetByState(ctx, s.hash(state))
+}
+
+func (s *HashedStore) ReserveAttempt(ctx context.Context, key string, at time.Time, ttl time.Duration) (Attempts, error) {
+	return s.FlowStore.ReserveAttempt(ctx, s.hash(key), at, ttl)
+}
+
+func (s *HashedStore) RefundAttempt(ctx context.Context, key string, at time.Time, previous Attempts) error {
+	return s.FlowStore.RefundAttempt(ctx, s.hash(key), at, previous)
+}
+
+func (s *HashedStore) GetAttempts(ctx context.Context, key string) (Attempts, error) {
+	return s.FlowStore.GetAttempts(ctx, s.hash(key))
+}
+
+// Close closes the wrapped store if it holds any resources.
+func (s *HashedStore) Close() error {
+	if closer, ok := s.FlowStore.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// MemoryStore keeps flows in process memory using go-cache.
+// Flows are lost on restart and not shared between replicas.
+type MemoryStore struct {
+	mu    sync.Mutex
+	cache *cache.Cache
+}
+
+// NewMemoryStore creates an in memory store which purges expired flows every cleanupInterval.
+func NewMemoryStore(defaultExpiration time.Duration, cleanupInterval time.Duration) *MemoryStore {
+	return &MemoryStore{
+		cache: cache.New(defaultExpiration, cleanupInterval),
+	}
+}
+
+func (s *MemoryStore) CreatePendingFlow(ctx context.Context, flow Flow, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	flow.Status = StatusPending
+	if err := s.cache.Add(userKey(flow.UserCode), flow.DeviceCode, ttl); err != nil {
+		return ErrUserCodeTaken
+	}
+	s.cache.Set(deviceKey(flow.DeviceCode), flow, ttl)
+	return nil
+}
+
+func (s *MemoryStore) GetByUserCode(ctx context.Context, userCode string) (*Flow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deviceCode, found := s.cache.Get(userKey(userCode))
+	if !found {
+		return nil, ErrNotFound
+	}
+	return s.get(deviceCode.(string))
+}
+
+func (s *MemoryStore) GetByDeviceCode(ctx context.Context, deviceCode string) (*Flow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.get(deviceCode)
+}
+
+func (s *MemoryStore) BindState(ctx context.Context, state string, deviceCode string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.get(deviceCode); err != nil {
+		return err
+	}
+	s.cache.Set(stateKey(state), deviceCode, ttl)
+	return nil
+}
+
+func (s *MemoryStore) GetByState(ctx context.Context, state string) (*Flow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deviceCode, found := s.cache.Get(stateKey(state))
+	if !found {
+		return nil, ErrNotFound
+	}
+	return s.get(deviceCode.(string))
+}
+
+func (s *MemoryStore) Approve(ctx context.Context, deviceCode string, session string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, expiration, found := s.cache.GetWithExpiration(deviceKey(deviceCode))
+	if !found {
+		return ErrNotFound
+	}
+	flow := item.(Flow)
+	if flow.Status != StatusPending {
+		return ErrNotFound
+	}
+	flow.ApprovedBy = session
+
+	s.cache.Set(deviceKey(deviceCode), flow, remaining(expiration))
+	return nil
+}
+
+func (s *MemoryStore) Complete(ctx context.Context, deviceCode string, tokenResponse string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	flow, err := s.get(deviceCode)
+	if err != nil {
+		return err
+	}
+	if flow.Status != StatusPending {
+		return ErrNotFound
+	}
+	flow.Status = StatusComplete
+	flow.TokenResponse = tokenResponse
+
+	s.cache.Set(deviceKey(deviceCode), *flow, ttl)
+	s.cache.Delete(userKey(flow.UserCode))
+	return nil
+}
+
+func (s *MemoryStore) Poll(ctx context.Context, deviceCode string, at time.Time) (PollResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, expiration, found := s.cache.GetWithExpiration(deviceKey(deviceCode))
+	if !found {
+		return PollResult{}, ErrNotFound
+	}
+	flow := item.(Flow)
+	result := flow.registerPoll(at)
+
+	s.cache.Set(deviceKey(deviceCode), flow, remaining(expiration))
+	return result, nil
+}
+
+func (s *MemoryStore) Deny(ctx context.Context, deviceCode string, description string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, expiration, found := s.cache.GetWithExpiration(deviceKey(deviceCode))
+	if !found {
+		return ErrNotFound
+	}
+	flow := item.(Flow)
+	flow.Status = StatusDenied
+	flow.ErrorDescription = description
+
+	s.cache.Set(deviceKey(deviceCode), flow, remaining(expiration))
+	s.cache.Delete(userKey(flow.UserCode))
+	return nil
+}
+
+func (s *MemoryStore) Redeem(ctx context.Context, deviceCode string) (*Flow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	flow, err := s.get(deviceCode)
+	if err != nil {
+		return nil, err
+	}
+	if flow.Status != StatusComplete {
+		return nil, ErrNotFound
+	}
+
+	s.cache.Delete(userKey(flow.UserCode))
+	s.cache.Delete(deviceKey(deviceCode))
+	return flow, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, deviceCode string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if flow, err := s.get(deviceCode); err == nil {
+		s.cache.Delete(userKey(flow.UserCode))
+	}
+	s.cache.Delete(deviceKey(deviceCode))
+	return nil
+}
+
+func (s *MemoryStore) ReserveAttempt(ctx context.Context, key string, at time.Time, ttl time.Duration) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous := Attempts{}
+	if item, found := s.cache.Get(attemptsKey(key)); found {
+		previous = item.(Attempts)
+	}
+
+	s.cache.Set(attemptsKey(key), Attempts{Failures: previous.Failures + 1, LastFailedAt: at}, ttl)
+	return previous, nil
+}
+
+func (s *MemoryStore) RefundAttempt(ctx context.Context, key string, at time.Time, previous Attempts) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, expiration, found := s.cache.GetWithExpiration(attemptsKey(key))
+	if !found {
+		return nil
+	}
+	attempts := item.(Attempts)
+	if attempts.Failures > 0 {
+		attempts.Failures--
+	}
+	if attempts.LastFailedAt.Equal(at) {
+		attempts.LastFailedAt = previous.LastFailedAt
+	}
+
+	s.cache.Set(attemptsKey(key), attempts, remaining(expiration))
+	return nil
+}
+
+func (s *MemoryStore) GetAttempts(ctx context.Context, key string) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item, found := s.cache.Get(attemptsKey(key)); found {
+		return item.(Attempts), nil
+	}
+	return Attempts{}, nil
+}
+
+// get must be called with the lock held.
+func (s *MemoryStore) get(deviceCode string) (*Flow, error) {
+	item, found := s.cache.Get(deviceKey(deviceCode))
+	if !found {
+		return nil, ErrNotFound
+	}
+	flow := item.(Flow)
+	return &flow, nil
+}
+
+// remaining converts an absolute go-cache expiration into a ttl, keeping entries without expiration forever.
+func remaining(expiration time.Time) time.Duration {
+	if expiration.IsZero() {
+		return cache.NoExpiration
+	}
+	if d := time.Until(expiration); d > 0 {
+		return d
+	}
+	return time.Nanosecond
+}
@@ -0,0 +1,29 @@
+CREATE TABLE device_authorizations (
+    device_code    TEXT PRIMARY KEY,
+    user_code      TEXT NOT NULL,
+    client_id      TEXT NOT NULL,
+    scope          TEXT NOT NULL DEFAULT '',
+    pkce_verifier  TEXT NOT NULL,
+    status         TEXT NOT NULL,
+    token_response TEXT NOT NULL DEFAULT '',
+    issued_at      TIMESTAMP NOT NULL,
+    expires_at     TIMESTAMP NOT NULL
+);
+
+CREATE INDEX device_authorizations_expires_at ON device_authorizations (expires_at);
+
+CREATE TABLE user_codes (
+    user_code   TEXT PRIMARY KEY,
+    device_code TEXT NOT NULL REFERENCES device_authorizations (device_code) ON DELETE CASCADE,
+    expires_at  TIMESTAMP NOT NULL
+);
+
+CREATE INDEX user_codes_device_code ON user_codes (device_code);
+
+CREATE TABLE state_bindings (
+    state       TEXT PRIMARY KEY,
+    device_code TEXT NOT NULL REFERENCES device_authorizations (device_code) ON DELETE CASCADE,
+    expires_at  TIMESTAMP NOT NULL
+);
+
+CREATE INDEX state_bindings_device_code ON state_bindings (device_code);
@@ -0,0 +1,3 @@
+ALTER TABLE device_authorizations ADD COLUMN poll_interval INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE device_authorizations ADD COLUMN last_polled_at TIMESTAMP NULL;
+ALTER TABLE device_authorizations ADD COLUMN slow_downs INTEGER NOT NULL DEFAULT 0;
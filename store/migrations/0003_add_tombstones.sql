@@ -0,0 +1,2 @@
+ALTER TABLE device_authorizations ADD COLUMN code_expires_at TIMESTAMP NULL;
+ALTER TABLE device_authorizations ADD COLUMN error_description TEXT NOT NULL DEFAULT '';
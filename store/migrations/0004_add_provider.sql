@@ -0,0 +1 @@
+ALTER TABLE device_authorizations ADD COLUMN provider TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+CREATE TABLE failed_attempts (
+    attempt_key        TEXT PRIMARY KEY,
+    failures           INTEGER NOT NULL,
+    last_failed_at     TIMESTAMP NOT NULL,
+    previous_failed_at TIMESTAMP NULL,
+    expires_at         TIMESTAMP NOT NULL
+);
+
+CREATE INDEX failed_attempts_expires_at ON failed_attempts (expires_at);
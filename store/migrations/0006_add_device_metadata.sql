@@ -0,0 +1,2 @@
+ALTER TABLE device_authorizations ADD COLUMN device_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE device_authorizations ADD COLUMN device_user_agent TEXT NOT NULL DEFAULT '';
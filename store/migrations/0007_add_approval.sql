@@ -0,0 +1 @@
+ALTER TABLE device_authorizations ADD COLUMN approved_by TEXT NOT NULL DEFAULT '';
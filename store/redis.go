@@ -0,0 +1,301 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// maxTxRetries is how many times an optimistic transaction is retried when a watched key changes.
+const maxTxRetries = 10
+
+// ErrConflict is returned when a flow kept changing while the store tried to update it.
+var ErrConflict = errors.New("flow was modified concurrently")
+
+// RedisStore keeps flows in redis, letting multiple replicas of the proxy share them.
+// Expiry is handled by native redis TTLs.
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisStore creates a store using the given client. All keys are prefixed with prefix.
+func NewRedisStore(client *redis.Client, prefix string) *RedisStore {
+	return &RedisStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+// Close closes the underlying redis client.
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *RedisStore) key(k string) string {
+	return s.prefix + k
+}
+
+func (s *RedisStore) CreatePendingFlow(ctx context.Context, flow Flow, ttl time.Duration) error {
+	flow.Status = StatusPending
+	data, err := json.Marshal(flow)
+	if err != nil {
+		return err
+	}
+
+	// Claim the user code first, a user entering it before the flow is stored is told it is not found
+	claimed, err := s.client.SetNX(ctx, s.key(userKey(flow.UserCode)), flow.DeviceCode, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return ErrUserCodeTaken
+	}
+
+	if err := s.client.Set(ctx, s.key(deviceKey(flow.DeviceCode)), data, ttl).Err(); err != nil {
+		s.client.Del(ctx, s.key(userKey(flow.UserCode)))
+		return err
+	}
+	return nil
+}
+
+func (s *RedisStore) GetByUserCode(ctx context.Context, userCode string) (*Flow, error) {
+	deviceCode, err := s.client.Get(ctx, s.key(userKey(userCode))).Result()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.get(ctx, s.client, deviceCode)
+}
+
+func (s *RedisStore) GetByDeviceCode(ctx context.Context, deviceCode string) (*Flow, error) {
+	return s.get(ctx, s.client, deviceCode)
+}
+
+func (s *RedisStore) BindState(ctx context.Context, state string, deviceCode string, ttl time.Duration) error {
+	n, err := s.client.Exists(ctx, s.key(deviceKey(deviceCode))).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return s.client.Set(ctx, s.key(stateKey(state)), deviceCode, ttl).Err()
+}
+
+func (s *RedisStore) GetByState(ctx context.Context, state string) (*Flow, error) {
+	deviceCode, err := s.client.Get(ctx, s.key(stateKey(state))).Result()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.get(ctx, s.client, deviceCode)
+}
+
+func (s *RedisStore) Approve(ctx context.Context, deviceCode string, session string) error {
+	return s.update(ctx, deviceCode, func(flow *Flow, pipe redis.Pipeliner) error {
+		if flow.Status != StatusPending {
+			return ErrNotFound
+		}
+		flow.ApprovedBy = session
+
+		data, err := json.Marshal(flow)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, s.key(deviceKey(deviceCode)), data, redis.KeepTTL)
+		return nil
+	})
+}
+
+func (s *RedisStore) Complete(ctx context.Context, deviceCode string, tokenResponse string, ttl time.Duration) error {
+	return s.update(ctx, deviceCode, func(flow *Flow, pipe redis.Pipeliner) error {
+		if flow.Status != StatusPending {
+			return ErrNotFound
+		}
+		flow.Status = StatusComplete
+		flow.TokenResponse = tokenResponse
+
+		data, err := json.Marshal(flow)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, s.key(deviceKey(deviceCode)), data, ttl)
+		pipe.Del(ctx, s.key(userKey(flow.UserCode)))
+		return nil
+	})
+}
+
+func (s *RedisStore) Poll(ctx context.Context, deviceCode string, at time.Time) (result PollResult, err error) {
+	err = s.update(ctx, deviceCode, func(flow *Flow, pipe redis.Pipeliner) error {
+		result = flow.registerPoll(at)
+
+		data, err := json.Marshal(flow)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, s.key(deviceKey(deviceCode)), data, redis.KeepTTL)
+		return nil
+	})
+	return result, err
+}
+
+func (s *RedisStore) Deny(ctx context.Context, deviceCode string, description string) error {
+	return s.update(ctx, deviceCode, func(flow *Flow, pipe redis.Pipeliner) error {
+		flow.Status = StatusDenied
+		flow.ErrorDescription = description
+
+		data, err := json.Marshal(flow)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, s.key(deviceKey(deviceCode)), data, redis.KeepTTL)
+		pipe.Del(ctx, s.key(userKey(flow.UserCode)))
+		return nil
+	})
+}
+
+func (s *RedisStore) Redeem(ctx context.Context, deviceCode string) (redeemed *Flow, err error) {
+	err = s.update(ctx, deviceCode, func(flow *Flow, pipe redis.Pipeliner) error {
+		if flow.Status != StatusComplete {
+			return ErrNotFound
+		}
+		redeemed = flow
+
+		pipe.Del(ctx, s.key(deviceKey(deviceCode)), s.key(userKey(flow.UserCode)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return redeemed, nil
+}
+
+func (s *RedisStore) Delete(ctx context.Context, deviceCode string) error {
+	err := s.update(ctx, deviceCode, func(flow *Flow, pipe redis.Pipeliner) error {
+		pipe.Del(ctx, s.key(deviceKey(deviceCode)), s.key(userKey(flow.UserCode)))
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// refundAttempt decrements the count of attempts, unless it expired meanwhile, and sets the last attempt back to
+// ARGV[2] when it still is the one refunded at ARGV[1].
+var refundAttempt = redis.NewScript(`
+if tonumber(redis.call("HGET", KEYS[1], "failures") or "0") > 0 then
+	if redis.call("HGET", KEYS[1], "last_failed_at") == ARGV[1] then
+		redis.call("HSET", KEYS[1], "last_failed_at", ARGV[2])
+	end
+	return redis.call("HINCRBY", KEYS[1], "failures", -1)
+end
+return 0
+`)
+
+func (s *RedisStore) ReserveAttempt(ctx context.Context, key string, at time.Time, ttl time.Duration) (Attempts, error) {
+	// Commands in a transaction run in order, so the previous values are read before they are changed
+	var previous *redis.SliceCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		previous = pipe.HMGet(ctx, s.key(attemptsKey(key)), "failures", "last_failed_at")
+		pipe.HIncrBy(ctx, s.key(attemptsKey(key)), "failures", 1)
+		pipe.HSet(ctx, s.key(attemptsKey(key)), "last_failed_at", unixNano(at))
+		pipe.PExpire(ctx, s.key(attemptsKey(key)), ttl)
+		return nil
+	})
+	if err != nil {
+		return Attempts{}, err
+	}
+	return parseAttempts(previous.Val())
+}
+
+func (s *RedisStore) RefundAttempt(ctx context.Context, key string, at time.Time, previous Attempts) error {
+	args := []interface{}{strconv.FormatInt(unixNano(at), 10), unixNano(previous.LastFailedAt)}
+	return refundAttempt.Run(ctx, s.client, []string{s.key(attemptsKey(key))}, args...).Err()
+}
+
+func (s *RedisStore) GetAttempts(ctx context.Context, key string) (Attempts, error) {
+	values, err := s.client.HMGet(ctx, s.key(attemptsKey(key)), "failures", "last_failed_at").Result()
+	if err != nil {
+		return Attempts{}, err
+	}
+	return parseAttempts(values)
+}
+
+// parseAttempts reads the failures and last_failed_at fields of an attempts hash.
+func parseAttempts(values []interface{}) (Attempts, error) {
+	if values[0] == nil || values[1] == nil {
+		return Attempts{}, nil
+	}
+
+	failures, err := strconv.Atoi(values[0].(string))
+	if err != nil {
+		return Attempts{}, err
+	}
+	lastFailedAt, err := strconv.ParseInt(values[1].(string), 10, 64)
+	if err != nil {
+		return Attempts{}, err
+	}
+	attempts := Attempts{Failures: failures}
+	if lastFailedAt != 0 {
+		attempts.LastFailedAt = time.Unix(0, lastFailedAt)
+	}
+	return attempts, nil
+}
+
+// unixNano is t in nanoseconds since the epoch, or 0 for the zero time which has no such representation.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// update runs fn inside an optimistic transaction watching the flow, so concurrent
+// writers on other replicas can never interleave with the read-modify-write.
+func (s *RedisStore) update(ctx context.Context, deviceCode string, fn func(flow *Flow, pipe redis.Pipeliner) error) error {
+	txf := func(tx *redis.Tx) error {
+		flow, err := s.get(ctx, tx, deviceCode)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return fn(flow, pipe)
+		})
+		return err
+	}
+
+	for i := 0; i < maxTxRetries; i++ {
+		err := s.client.Watch(ctx, txf, s.key(deviceKey(deviceCode)))
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return ErrConflict
+}
+
+func (s *RedisStore) get(ctx context.Context, c redis.Cmdable, deviceCode string) (*Flow, error) {
+	data, err := c.Get(ctx, s.key(deviceKey(deviceCode))).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	flow := Flow{}
+	if err := json.Unmarshal(data, &flow); err != nil {
+		return nil, err
+	}
+	return &flow, nil
+}
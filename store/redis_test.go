@@ -0,0 +1,45 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestRedisStore(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisStore(client, "test:"), mr
+}
+
+func TestRedisStore(t *testing.T) {
+	s, _ := newTestRedisStore(t)
+	testFlowStore(t, s)
+}
+
+func TestRedisStoreExpiry(t *testing.T) {
+	s, mr := newTestRedisStore(t)
+	ctx := context.Background()
+
+	flow := Flow{DeviceCode: "device-code", UserCode: "USERCODE"}
+	if err := s.CreatePendingFlow(ctx, flow, 5*time.Minute); err != nil {
+		t.Fatalf("CreatePendingFlow: %v", err)
+	}
+	if ttl := mr.TTL("test:device:device-code"); ttl != 5*time.Minute {
+		t.Fatalf("device code ttl is %v, want 5m", ttl)
+	}
+
+	mr.FastForward(5 * time.Minute)
+
+	if _, err := s.GetByDeviceCode(ctx, "device-code"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetByDeviceCode after expiry returned %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetByUserCode(ctx, "USERCODE"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetByUserCode after expiry returned %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,376 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DialectSqlite is used for sqlite databases, eg. through modernc.org/sqlite.
+	DialectSqlite = "sqlite"
+	// DialectPostgres is used for postgres databases, eg. through github.com/lib/pq.
+	DialectPostgres = "postgres"
+)
+
+const flowColumns = `device_code, user_code, client_id, scope, pkce_verifier, status, token_response, issued_at, poll_interval, last_polled_at, slow_downs, code_expires_at, error_description, provider, device_name, device_user_agent, approved_by`
+
+// SQLStore keeps flows in a relational database so they can be queried and audited.
+// Expired rows are removed by a background sweeper.
+type SQLStore struct {
+	db      *sql.DB
+	dialect string
+	done    chan struct{}
+}
+
+// NewSQLStore creates a store on db, sweeping expired rows every purgeInterval. A zero purgeInterval disables the sweeper.
+// The schema must be created with Migrate before the store is used.
+func NewSQLStore(db *sql.DB, dialect string, purgeInterval time.Duration) (*SQLStore, error) {
+	if dialect != DialectSqlite && dialect != DialectPostgres {
+		return nil, fmt.Errorf("unsupported sql dialect %s", dialect)
+	}
+
+	if dialect == DialectSqlite {
+		// sqlite allows a single writer, serialize access instead of failing with SQLITE_BUSY
+		db.SetMaxOpenConns(1)
+	}
+
+	s := &SQLStore{
+		db:      db,
+		dialect: dialect,
+		done:    make(chan struct{}),
+	}
+	if purgeInterval > 0 {
+		go s.sweepExpired(purgeInterval)
+	}
+
+	return s, nil
+}
+
+// Close stops the sweeper and closes the database.
+func (s *SQLStore) Close() error {
+	close(s.done)
+	return s.db.Close()
+}
+
+func (s *SQLStore) CreatePendingFlow(ctx context.Context, flow Flow, ttl time.Duration) error {
+	expiresAt := time.Now().Add(ttl).UTC()
+
+	return s.transaction(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO device_authorizations (`+flowColumns+`, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			flow.DeviceCode, flow.UserCode, flow.ClientId, flow.Scope, flow.PkceVerifier, StatusPending, "", flow.IssuedAt.UTC(), flow.Interval, nil, 0, nullTime(flow.ExpiresAt), "", flow.Provider,
+			flow.DeviceName, flow.DeviceUserAgent, "", expiresAt)
+		if err != nil {
+			return err
+		}
+
+		// Replace the user code of an expired flow not yet swept, but never one in use
+		if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM user_codes WHERE user_code = ? AND expires_at <= ?`), flow.UserCode, time.Now().UTC()); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO user_codes (user_code, device_code, expires_at) VALUES (?, ?, ?)
+			ON CONFLICT (user_code) DO NOTHING`), flow.UserCode, flow.DeviceCode, expiresAt)
+		if err != nil {
+			return err
+		}
+		inserted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if inserted == 0 {
+			return ErrUserCodeTaken
+		}
+		return nil
+	})
+}
+
+func (s *SQLStore) GetByUserCode(ctx context.Context, userCode string) (*Flow, error) {
+	now := time.Now().UTC()
+	row := s.db.QueryRowContext(ctx, s.rebind(`SELECT `+prefixColumns("d")+` FROM user_codes u
+		JOIN device_authorizations d ON d.device_code = u.device_code
+		WHERE u.user_code = ? AND u.expires_at > ? AND d.expires_at > ?`), userCode, now, now)
+	return scanFlow(row)
+}
+
+func (s *SQLStore) GetByDeviceCode(ctx context.Context, deviceCode string) (*Flow, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind(`SELECT `+flowColumns+` FROM device_authorizations
+		WHERE device_code = ? AND expires_at > ?`), deviceCode, time.Now().UTC())
+	return scanFlow(row)
+}
+
+func (s *SQLStore) BindState(ctx context.Context, state string, deviceCode string, ttl time.Duration) error {
+	if _, err := s.GetByDeviceCode(ctx, deviceCode); err != nil {
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO state_bindings (state, device_code, expires_at) VALUES (?, ?, ?)`),
+		state, deviceCode, time.Now().Add(ttl).UTC())
+	return err
+}
+
+func (s *SQLStore) GetByState(ctx context.Context, state string) (*Flow, error) {
+	now := time.Now().UTC()
+	row := s.db.QueryRowContext(ctx, s.rebind(`SELECT `+prefixColumns("d")+` FROM state_bindings b
+		JOIN device_authorizations d ON d.device_code = b.device_code
+		WHERE b.state = ? AND b.expires_at > ? AND d.expires_at > ?`), state, now, now)
+	return scanFlow(row)
+}
+
+func (s *SQLStore) Approve(ctx context.Context, deviceCode string, session string) error {
+	res, err := s.db.ExecContext(ctx, s.rebind(`UPDATE device_authorizations SET approved_by = ?
+		WHERE device_code = ? AND status = ? AND expires_at > ?`), session, deviceCode, StatusPending, time.Now().UTC())
+	return expectAffected(res, err)
+}
+
+func (s *SQLStore) Complete(ctx context.Context, deviceCode string, tokenResponse string, ttl time.Duration) error {
+	return s.transaction(ctx, func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		res, err := tx.ExecContext(ctx, s.rebind(`UPDATE device_authorizations SET status = ?, token_response = ?, expires_at = ?
+			WHERE device_code = ? AND status = ? AND expires_at > ?`), StatusComplete, tokenResponse, now.Add(ttl), deviceCode, StatusPending, now)
+		if err := expectAffected(res, err); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, s.rebind(`DELETE FROM user_codes WHERE device_code = ?`), deviceCode)
+		return err
+	})
+}
+
+func (s *SQLStore) Poll(ctx context.Context, deviceCode string, at time.Time) (result PollResult, err error) {
+	err = s.transaction(ctx, func(tx *sql.Tx) error {
+		row := tx.QueryRowContext(ctx, s.rebind(`SELECT `+flowColumns+` FROM device_authorizations
+			WHERE device_code = ? AND expires_at > ?`+s.forUpdate()), deviceCode, time.Now().UTC())
+		flow, err := scanFlow(row)
+		if err != nil {
+			return err
+		}
+		result = flow.registerPoll(at)
+
+		_, err = tx.ExecContext(ctx, s.rebind(`UPDATE device_authorizations SET poll_interval = ?, last_polled_at = ?, slow_downs = ?
+			WHERE device_code = ?`), flow.Interval, flow.LastPolledAt.UTC(), flow.SlowDowns, deviceCode)
+		return err
+	})
+	return result, err
+}
+
+func (s *SQLStore) Deny(ctx context.Context, deviceCode string, description string) error {
+	return s.transaction(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, s.rebind(`UPDATE device_authorizations SET status = ?, error_description = ?
+			WHERE device_code = ? AND expires_at > ?`), StatusDenied, description, deviceCode, time.Now().UTC())
+		if err := expectAffected(res, err); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, s.rebind(`DELETE FROM user_codes WHERE device_code = ?`), deviceCode)
+		return err
+	})
+}
+
+func (s *SQLStore) Redeem(ctx context.Context, deviceCode string) (flow *Flow, err error) {
+	err = s.transaction(ctx, func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		row := tx.QueryRowContext(ctx, s.rebind(`SELECT `+flowColumns+` FROM device_authorizations
+			WHERE device_code = ? AND status = ? AND expires_at > ?`+s.forUpdate()), deviceCode, StatusComplete, now)
+		flow, err = scanFlow(row)
+		if err != nil {
+			return err
+		}
+
+		for _, table := range []string{"user_codes", "state_bindings"} {
+			if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM `+table+` WHERE device_code = ?`), deviceCode); err != nil {
+				return err
+			}
+		}
+		// Only the transaction deleting the row hands out the token, should another one have slipped past the lock
+		res, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM device_authorizations WHERE device_code = ? AND status = ?`), deviceCode, StatusComplete)
+		return expectAffected(res, err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return flow, nil
+}
+
+func (s *SQLStore) Delete(ctx context.Context, deviceCode string) error {
+	return s.transaction(ctx, func(tx *sql.Tx) error {
+		for _, table := range []string{"user_codes", "state_bindings", "device_authorizations"} {
+			if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM `+table+` WHERE device_code = ?`), deviceCode); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLStore) ReserveAttempt(ctx context.Context, key string, at time.Time, ttl time.Duration) (previous Attempts, err error) {
+	err = s.transaction(ctx, func(tx *sql.Tx) error {
+		// The upsert locks the row, and keeps the previous attempt so it is read without racing other attempts.
+		// Counting starts over once the attempts of the key expired, even when not swept yet.
+		_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO failed_attempts (attempt_key, failures, last_failed_at, previous_failed_at, expires_at) VALUES (?, 1, ?, NULL, ?)
+			ON CONFLICT (attempt_key) DO UPDATE SET
+				failures = CASE WHEN failed_attempts.expires_at > ? THEN failed_attempts.failures + 1 ELSE 1 END,
+				previous_failed_at = CASE WHEN failed_attempts.expires_at > ? THEN failed_attempts.last_failed_at ELSE NULL END,
+				last_failed_at = excluded.last_failed_at,
+				expires_at = excluded.expires_at`), key, at.UTC(), at.Add(ttl).UTC(), at.UTC(), at.UTC())
+		if err != nil {
+			return err
+		}
+
+		previousFailedAt := sql.NullTime{}
+		row := tx.QueryRowContext(ctx, s.rebind(`SELECT failures, previous_failed_at FROM failed_attempts WHERE attempt_key = ?`), key)
+		if err := row.Scan(&previous.Failures, &previousFailedAt); err != nil {
+			return err
+		}
+		previous.Failures--
+		previous.LastFailedAt = previousFailedAt.Time
+		return nil
+	})
+	return previous, err
+}
+
+func (s *SQLStore) RefundAttempt(ctx context.Context, key string, at time.Time, previous Attempts) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`UPDATE failed_attempts SET failures = failures - 1,
+			last_failed_at = CASE WHEN last_failed_at = ? THEN ? ELSE last_failed_at END
+		WHERE attempt_key = ? AND failures > 0 AND expires_at > ?`), at.UTC(), previous.LastFailedAt.UTC(), key, time.Now().UTC())
+	return err
+}
+
+func (s *SQLStore) GetAttempts(ctx context.Context, key string) (Attempts, error) {
+	attempts := Attempts{}
+	row := s.db.QueryRowContext(ctx, s.rebind(`SELECT failures, last_failed_at FROM failed_attempts
+		WHERE attempt_key = ? AND expires_at > ?`), key, time.Now().UTC())
+	err := row.Scan(&attempts.Failures, &attempts.LastFailedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Attempts{}, nil
+	}
+	return attempts, err
+}
+
+// sweepExpired deletes expired rows every interval until the store is closed.
+func (s *SQLStore) sweepExpired(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.sweep(context.Background(), time.Now()); err != nil {
+				log.Error().Err(err).Msg("Unable to sweep expired device flows")
+			}
+		}
+	}
+}
+
+func (s *SQLStore) sweep(ctx context.Context, now time.Time) error {
+	return s.transaction(ctx, func(tx *sql.Tx) error {
+		// Children first, they may outlive the flow they point at
+		for _, table := range []string{"user_codes", "state_bindings"} {
+			_, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM `+table+` WHERE expires_at <= ?
+				OR device_code IN (SELECT device_code FROM device_authorizations WHERE expires_at <= ?)`), now.UTC(), now.UTC())
+			if err != nil {
+				return err
+			}
+		}
+		for _, table := range []string{"device_authorizations", "failed_attempts"} {
+			if _, err := tx.ExecContext(ctx, s.rebind(`DELETE FROM `+table+` WHERE expires_at <= ?`), now.UTC()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLStore) transaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// forUpdate locks selected rows until the transaction ends. sqlite has no row locks, but only a single connection.
+func (s *SQLStore) forUpdate() string {
+	if s.dialect == DialectPostgres {
+		return " FOR UPDATE"
+	}
+	return ""
+}
+
+// rebind rewrites ? placeholders to the positional $n form used by postgres.
+func (s *SQLStore) rebind(query string) string {
+	if s.dialect != DialectPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func prefixColumns(alias string) string {
+	columns := strings.Split(flowColumns, ", ")
+	for i, c := range columns {
+		columns[i] = alias + "." + c
+	}
+	return strings.Join(columns, ", ")
+}
+
+func scanFlow(row *sql.Row) (*Flow, error) {
+	flow := Flow{}
+	lastPolledAt := sql.NullTime{}
+	expiresAt := sql.NullTime{}
+	err := row.Scan(&flow.DeviceCode, &flow.UserCode, &flow.ClientId, &flow.Scope, &flow.PkceVerifier, &flow.Status, &flow.TokenResponse, &flow.IssuedAt,
+		&flow.Interval, &lastPolledAt, &flow.SlowDowns, &expiresAt, &flow.ErrorDescription, &flow.Provider,
+		&flow.DeviceName, &flow.DeviceUserAgent, &flow.ApprovedBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	flow.LastPolledAt = lastPolledAt.Time
+	flow.ExpiresAt = expiresAt.Time
+	return &flow, nil
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	if t.IsZero() {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+func expectAffected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func newTestSQLStore(t *testing.T) *SQLStore {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "flows.sqlite"))
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+
+	s, err := NewSQLStore(db, DialectSqlite, 0)
+	if err != nil {
+		t.Fatalf("NewSQLStore: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	if err := s.Migrate(context.Background()); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	return s
+}
+
+func TestSQLStore(t *testing.T) {
+	testFlowStore(t, newTestSQLStore(t))
+}
+
+func TestSQLStoreMigrateIsIdempotent(t *testing.T) {
+	s := newTestSQLStore(t)
+
+	if err := s.Migrate(context.Background()); err != nil {
+		t.Fatalf("second Migrate: %v", err)
+	}
+
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatalf("Migrations: %v", err)
+	}
+
+	var applied int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		t.Fatalf("count schema_migrations: %v", err)
+	}
+	if applied != len(migrations) {
+		t.Fatalf("%d migrations recorded, want %d", applied, len(migrations))
+	}
+}
+
+func TestSQLStoreSweep(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSQLStore(t)
+
+	if err := s.CreatePendingFlow(ctx, Flow{DeviceCode: "device-code", UserCode: "USERCODE", IssuedAt: time.Now()}, time.Minute); err != nil {
+		t.Fatalf("CreatePendingFlow: %v", err)
+	}
+	if err := s.BindState(ctx, "state", "device-code", time.Minute); err != nil {
+		t.Fatalf("BindState: %v", err)
+	}
+	if _, err := s.ReserveAttempt(ctx, "ip:192.0.2.1", time.Now(), time.Minute); err != nil {
+		t.Fatalf("ReserveAttempt: %v", err)
+	}
+
+	if err := s.sweep(ctx, time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+
+	for _, table := range []string{"device_authorizations", "user_codes", "state_bindings", "failed_attempts"} {
+		var n int
+		if err := s.db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+			t.Fatalf("count %s: %v", table, err)
+		}
+		if n != 0 {
+			t.Errorf("%s has %d rows after sweep, want 0", table, n)
+		}
+	}
+}
+
+func TestSQLStoreRebind(t *testing.T) {
+	s := &SQLStore{dialect: DialectPostgres}
+
+	got := s.rebind(`UPDATE t SET a = ? WHERE b = ? AND c > ?`)
+	want := `UPDATE t SET a = $1 WHERE b = $2 AND c > $3`
+	if got != want {
+		t.Fatalf("rebind returned %q, want %q", got, want)
+	}
+}
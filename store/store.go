@@ -0,0 +1,174 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned when no flow exists for the given code or state.
+var ErrNotFound = errors.New("flow not found")
+
+// ErrUserCodeTaken is returned when creating a flow with a user code another flow still uses.
+var ErrUserCodeTaken = errors.New("user code already in use")
+
+// SlowDownIncrement is how many seconds the poll interval grows each time a device polls too fast, see RFC 8628 section 3.5.
+const SlowDownIncrement = 5
+
+// Status is the state a device flow is in.
+type Status string
+
+const (
+	// StatusPending is a flow waiting for the user to sign in.
+	StatusPending Status = "pending"
+	// StatusComplete is a flow where the token response is ready for the device.
+	StatusComplete Status = "complete"
+	// StatusDenied is a flow which the user or the authorization server rejected, or which failed.
+	StatusDenied Status = "denied"
+)
+
+// Flow is a single device authorization request and everything needed to finish it.
+type Flow struct {
+	DeviceCode    string    `json:"device_code"`
+	UserCode      string    `json:"user_code"`
+	ClientId      string    `json:"client_id"`
+	Scope         string    `json:"scope,omitempty"`
+	PkceVerifier  string    `json:"pkce_verifier"`
+	Status        Status    `json:"status"`
+	TokenResponse string    `json:"token_response,omitempty"`
+	IssuedAt      time.Time `json:"iat"`
+
+	// Provider is the name of the upstream provider the user signs in with.
+	Provider string `json:"provider,omitempty"`
+
+	// DeviceName and DeviceUserAgent are told by the device when requesting the codes, and shown to the user
+	// approving it. They are not verified in any way.
+	DeviceName      string `json:"device_name,omitempty"`
+	DeviceUserAgent string `json:"device_user_agent,omitempty"`
+
+	// ExpiresAt is when the codes expire. The store keeps the flow longer than that as a tombstone,
+	// so the device can be told the code expired instead of being unknown.
+	ExpiresAt time.Time `json:"expires_at"`
+	// ErrorDescription tells why a flow was denied.
+	ErrorDescription string `json:"error_description,omitempty"`
+	// ApprovedBy identifies the browser session the user approved the device in, empty until approved.
+	// Only that browser may finish the flow when redirected back by the provider.
+	ApprovedBy string `json:"approved_by,omitempty"`
+
+	// Interval is the number of seconds the device must wait between polls.
+	Interval     int       `json:"interval"`
+	LastPolledAt time.Time `json:"last_polled_at,omitempty"`
+	SlowDowns    int       `json:"slow_downs,omitempty"`
+}
+
+// PollResult tells how a poll recorded with FlowStore.Poll was received.
+type PollResult struct {
+	// SlowDown is set when the device polled before Interval had passed.
+	SlowDown bool
+	// Interval is the number of seconds the device must now wait between polls.
+	Interval int
+	// SlowDowns is how many times the device has polled too fast.
+	SlowDowns int
+}
+
+// Attempts are the wrong user code entries counted for a key, eg. an IP address or a browser session.
+type Attempts struct {
+	Failures     int       `json:"failures"`
+	LastFailedAt time.Time `json:"last_failed_at"`
+}
+
+// Expired tells if the codes of the flow have expired.
+func (f *Flow) Expired(now time.Time) bool {
+	return !f.ExpiresAt.IsZero() && !now.Before(f.ExpiresAt)
+}
+
+// registerPoll records a poll at the given time. Polling before the interval has passed
+// increases the interval by SlowDownIncrement.
+func (f *Flow) registerPoll(at time.Time) PollResult {
+	slowDown := !f.LastPolledAt.IsZero() && at.Sub(f.LastPolledAt) < time.Duration(f.Interval)*time.Second
+	if slowDown {
+		f.Interval += SlowDownIncrement
+		f.SlowDowns++
+	}
+	f.LastPolledAt = at
+
+	return PollResult{
+		SlowDown:  slowDown,
+		Interval:  f.Interval,
+		SlowDowns: f.SlowDowns,
+	}
+}
+
+// FlowStore persists device flows between the device and browser endpoints.
+//
+// Lookups take the code as presented by the device or the user. Mutations
+// take the DeviceCode of a flow previously returned by the store.
+type FlowStore interface {
+	// CreatePendingFlow stores a new pending flow, findable by both user code and device code until ttl passes.
+	// The ttl should outlast ExpiresAt of the flow to keep a tombstone of it. ErrUserCodeTaken is returned, and
+	// nothing stored, when the user code belongs to a flow that is neither complete, denied nor gone.
+	CreatePendingFlow(ctx context.Context, flow Flow, ttl time.Duration) error
+
+	// GetByUserCode returns the flow the user code was issued for.
+	GetByUserCode(ctx context.Context, userCode string) (*Flow, error)
+
+	// GetByDeviceCode returns the flow the device code was issued for.
+	GetByDeviceCode(ctx context.Context, deviceCode string) (*Flow, error)
+
+	// BindState binds an authorization request state parameter to a flow.
+	BindState(ctx context.Context, state string, deviceCode string, ttl time.Duration) error
+
+	// GetByState returns the flow a state parameter was bound to.
+	GetByState(ctx context.Context, state string) (*Flow, error)
+
+	// Approve records that the user approved a flow in the browser session identified by session.
+	// ErrNotFound is returned when the flow is not pending.
+	Approve(ctx context.Context, deviceCode string, session string) error
+
+	// Complete marks a flow complete with the upstream token response, which is kept for ttl.
+	// The user code can no longer be used once the flow is complete. ErrNotFound is returned when the flow is not
+	// pending, so a denied flow is never handed a token.
+	Complete(ctx context.Context, deviceCode string, tokenResponse string, ttl time.Duration) error
+
+	// Poll records that the device polled the flow at the given time, slowing it down if it polls too fast.
+	Poll(ctx context.Context, deviceCode string, at time.Time) (PollResult, error)
+
+	// Redeem removes a complete flow and returns it, atomically so the token response is handed out only once.
+	// ErrNotFound is returned when the flow is not complete, or was already redeemed.
+	Redeem(ctx context.Context, deviceCode string) (*Flow, error)
+
+	// Deny marks a flow as denied, keeping description of why for the device. The user code can no longer be used.
+	Deny(ctx context.Context, deviceCode string, description string) error
+
+	// Delete removes a flow and its user code.
+	Delete(ctx context.Context, deviceCode string) error
+
+	// ReserveAttempt counts a user code entry for key at the given time, before the code is looked up, and returns the
+	// attempts counted before it. Counting and reading happen atomically, so parallel entries each see the ones before.
+	// The count is forgotten ttl after the last attempt.
+	ReserveAttempt(ctx context.Context, key string, at time.Time, ttl time.Duration) (Attempts, error)
+
+	// RefundAttempt uncounts the attempt reserved for key at the given time, when the code entered turned out right or
+	// was never looked up. previous are the attempts ReserveAttempt returned for it. The last attempt is set back to
+	// theirs, unless another one was reserved since, so a refunded attempt never restarts a lockout.
+	RefundAttempt(ctx context.Context, key string, at time.Time, previous Attempts) error
+
+	// GetAttempts returns the failed user code entries counted for key, no failures if none are.
+	GetAttempts(ctx context.Context, key string) (Attempts, error)
+}
+
+func deviceKey(deviceCode string) string {
+	return "device:" + deviceCode
+}
+
+func userKey(userCode string) string {
+	return "user:" + userCode
+}
+
+func stateKey(state string) string {
+	return "state:" + state
+}
+
+func attemptsKey(key string) string {
+	return "attempts:" + key
+}
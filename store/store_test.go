@@ -0,0 +1,403 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wraix/device-flow-proxy/keyring"
+)
+
+// testFlowStore runs the behaviour every FlowStore backend must share.
+func testFlowStore(t *testing.T, s FlowStore) {
+	ctx := context.Background()
+
+	flow := Flow{
+		DeviceCode:   "device-code",
+		UserCode:     "USERCODE",
+		ClientId:     "client",
+		Scope:        "openid offline_access",
+		Provider:     "hydra",
+		PkceVerifier: "verifier",
+		DeviceName:   "Living room TV",
+		IssuedAt:     time.Now(),
+		ExpiresAt:    time.Now().Add(time.Minute),
+		Interval:     5,
+	}
+
+	if err := s.CreatePendingFlow(ctx, flow, time.Minute); err != nil {
+		t.Fatalf("CreatePendingFlow: %v", err)
+	}
+
+	got, err := s.GetByUserCode(ctx, "USERCODE")
+	if err != nil {
+		t.Fatalf("GetByUserCode: %v", err)
+	}
+	if got.ClientId != flow.ClientId || got.Status != StatusPending || got.Scope != flow.Scope || got.Provider != flow.Provider || got.DeviceName != flow.DeviceName || !got.ExpiresAt.Equal(flow.ExpiresAt) {
+		t.Fatalf("GetByUserCode returned %+v", got)
+	}
+	// Mutations take the device code as stored, which may differ from the presented one
+	deviceCode := got.DeviceCode
+
+	collision := flow
+	collision.DeviceCode = "other-device-code"
+	if err := s.CreatePendingFlow(ctx, collision, time.Minute); !errors.Is(err, ErrUserCodeTaken) {
+		t.Fatalf("CreatePendingFlow with a user code in use returned %v, want ErrUserCodeTaken", err)
+	}
+	if got, err := s.GetByUserCode(ctx, "USERCODE"); err != nil || got.DeviceCode != deviceCode {
+		t.Fatalf("user code taken over by colliding flow, got %+v, %v", got, err)
+	}
+	if _, err := s.GetByDeviceCode(ctx, collision.DeviceCode); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("colliding flow stored, got %v", err)
+	}
+
+	if _, err := s.GetByDeviceCode(ctx, "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetByDeviceCode of unknown code returned %v, want ErrNotFound", err)
+	}
+
+	now := time.Now()
+	if result, err := s.Poll(ctx, deviceCode, now); err != nil || result.SlowDown {
+		t.Fatalf("first Poll returned %+v, %v", result, err)
+	}
+	result, err := s.Poll(ctx, deviceCode, now.Add(time.Second))
+	if err != nil {
+		t.Fatalf("Poll: %v", err)
+	}
+	if !result.SlowDown || result.Interval != 5+SlowDownIncrement || result.SlowDowns != 1 {
+		t.Fatalf("Poll too early returned %+v", result)
+	}
+	if result, err := s.Poll(ctx, deviceCode, now.Add(12*time.Second)); err != nil || result.SlowDown {
+		t.Fatalf("Poll after interval returned %+v, %v", result, err)
+	}
+
+	if err := s.BindState(ctx, "state", "unknown", time.Minute); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("BindState to unknown flow returned %v, want ErrNotFound", err)
+	}
+	if err := s.BindState(ctx, "state", deviceCode, time.Minute); err != nil {
+		t.Fatalf("BindState: %v", err)
+	}
+	got, err = s.GetByState(ctx, "state")
+	if err != nil {
+		t.Fatalf("GetByState: %v", err)
+	}
+	if got.DeviceCode != deviceCode {
+		t.Fatalf("GetByState returned %+v", got)
+	}
+
+	if got.ApprovedBy != "" {
+		t.Fatalf("GetByState returned a flow approved before Approve: %+v", got)
+	}
+	if err := s.Approve(ctx, deviceCode, "session"); err != nil {
+		t.Fatalf("Approve: %v", err)
+	}
+	if got, err := s.GetByState(ctx, "state"); err != nil || got.ApprovedBy != "session" || got.Status != StatusPending {
+		t.Fatalf("GetByState after Approve returned %+v, %v", got, err)
+	}
+
+	if err := s.Complete(ctx, deviceCode, `{"access_token":"token"}`, time.Minute); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	got, err = s.GetByDeviceCode(ctx, flow.DeviceCode)
+	if err != nil {
+		t.Fatalf("GetByDeviceCode: %v", err)
+	}
+	if got.Status != StatusComplete || got.TokenResponse != `{"access_token":"token"}` {
+		t.Fatalf("GetByDeviceCode after Complete returned %+v", got)
+	}
+	if _, err := s.GetByUserCode(ctx, "USERCODE"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("user code usable after Complete, got %v", err)
+	}
+	if err := s.Complete(ctx, deviceCode, `{"access_token":"other"}`, time.Minute); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second Complete returned %v, want ErrNotFound", err)
+	}
+
+	redeemed, err := s.Redeem(ctx, deviceCode)
+	if err != nil {
+		t.Fatalf("Redeem: %v", err)
+	}
+	if redeemed.TokenResponse != `{"access_token":"token"}` {
+		t.Fatalf("Redeem returned %+v", redeemed)
+	}
+	if _, err := s.Redeem(ctx, deviceCode); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second Redeem returned %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetByDeviceCode(ctx, flow.DeviceCode); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("flow found after Redeem, got %v", err)
+	}
+	if err := s.Delete(ctx, deviceCode); err != nil {
+		t.Fatalf("Delete of redeemed flow: %v", err)
+	}
+
+	denied := flow
+	denied.DeviceCode = "denied-device-code"
+	denied.UserCode = "DENIED"
+	if err := s.CreatePendingFlow(ctx, denied, time.Minute); err != nil {
+		t.Fatalf("CreatePendingFlow: %v", err)
+	}
+	got, err = s.GetByDeviceCode(ctx, denied.DeviceCode)
+	if err != nil {
+		t.Fatalf("GetByDeviceCode: %v", err)
+	}
+	if err := s.Deny(ctx, got.DeviceCode, "The user denied access"); err != nil {
+		t.Fatalf("Deny: %v", err)
+	}
+	got, err = s.GetByDeviceCode(ctx, denied.DeviceCode)
+	if err != nil {
+		t.Fatalf("GetByDeviceCode: %v", err)
+	}
+	if got.Status != StatusDenied || got.ErrorDescription != "The user denied access" {
+		t.Fatalf("GetByDeviceCode after Deny returned %+v", got)
+	}
+	if _, err := s.GetByUserCode(ctx, "DENIED"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("user code usable after Deny, got %v", err)
+	}
+	reused := denied
+	reused.DeviceCode = "reused-device-code"
+	if err := s.CreatePendingFlow(ctx, reused, time.Minute); err != nil {
+		t.Fatalf("CreatePendingFlow with the user code of a denied flow: %v", err)
+	}
+	if flow, err := s.GetByUserCode(ctx, "DENIED"); err != nil || flow.DeviceCode == got.DeviceCode {
+		t.Fatalf("GetByUserCode of reused user code returned %+v, %v", flow, err)
+	}
+	if _, err := s.Redeem(ctx, got.DeviceCode); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Redeem of denied flow returned %v, want ErrNotFound", err)
+	}
+	if err := s.Approve(ctx, got.DeviceCode, "session"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Approve of denied flow returned %v, want ErrNotFound", err)
+	}
+	if err := s.Complete(ctx, got.DeviceCode, `{"access_token":"token"}`, time.Minute); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Complete of denied flow returned %v, want ErrNotFound", err)
+	}
+	if got, err := s.GetByDeviceCode(ctx, denied.DeviceCode); err != nil || got.Status != StatusDenied || got.TokenResponse != "" || got.ApprovedBy != "" {
+		t.Fatalf("GetByDeviceCode after Complete of denied flow returned %+v, %v", got, err)
+	}
+	if err := s.Delete(ctx, got.DeviceCode); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.GetByDeviceCode(ctx, denied.DeviceCode); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("flow found after Delete, got %v", err)
+	}
+
+	testConcurrentRedeem(t, s)
+	testAttempts(t, s)
+}
+
+func testAttempts(t *testing.T, s FlowStore) {
+	ctx := context.Background()
+
+	if attempts, err := s.GetAttempts(ctx, "ip:192.0.2.1"); err != nil || attempts.Failures != 0 {
+		t.Fatalf("GetAttempts of unknown key returned %+v, %v", attempts, err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	reserved := []Attempts{}
+	for i := 0; i < 3; i++ {
+		previous, err := s.ReserveAttempt(ctx, "ip:192.0.2.1", now.Add(time.Duration(i)*time.Second), time.Minute)
+		if err != nil {
+			t.Fatalf("ReserveAttempt: %v", err)
+		}
+		if previous.Failures != i {
+			t.Fatalf("ReserveAttempt %d returned %d attempts before it", i+1, previous.Failures)
+		}
+		if i > 0 && !previous.LastFailedAt.Equal(now.Add(time.Duration(i-1)*time.Second)) {
+			t.Fatalf("ReserveAttempt %d returned the previous attempt at %v", i+1, previous.LastFailedAt)
+		}
+		reserved = append(reserved, previous)
+	}
+
+	attempts, err := s.GetAttempts(ctx, "ip:192.0.2.1")
+	if err != nil {
+		t.Fatalf("GetAttempts: %v", err)
+	}
+	if attempts.Failures != 3 || !attempts.LastFailedAt.Equal(now.Add(2*time.Second)) {
+		t.Fatalf("GetAttempts returned %+v", attempts)
+	}
+
+	// Refunding the last attempt sets the last attempt back to the one before it
+	if err := s.RefundAttempt(ctx, "ip:192.0.2.1", now.Add(2*time.Second), reserved[2]); err != nil {
+		t.Fatalf("RefundAttempt: %v", err)
+	}
+	if attempts, err := s.GetAttempts(ctx, "ip:192.0.2.1"); err != nil || attempts.Failures != 2 || !attempts.LastFailedAt.Equal(now.Add(time.Second)) {
+		t.Fatalf("GetAttempts after RefundAttempt returned %+v, %v", attempts, err)
+	}
+
+	// Refunding an attempt reserved before another keeps the later one as the last attempt
+	previous, err := s.ReserveAttempt(ctx, "ip:192.0.2.1", now.Add(3*time.Second), time.Minute)
+	if err != nil {
+		t.Fatalf("ReserveAttempt: %v", err)
+	}
+	if _, err := s.ReserveAttempt(ctx, "ip:192.0.2.1", now.Add(4*time.Second), time.Minute); err != nil {
+		t.Fatalf("ReserveAttempt: %v", err)
+	}
+	if err := s.RefundAttempt(ctx, "ip:192.0.2.1", now.Add(3*time.Second), previous); err != nil {
+		t.Fatalf("RefundAttempt: %v", err)
+	}
+	if attempts, err := s.GetAttempts(ctx, "ip:192.0.2.1"); err != nil || attempts.Failures != 3 || !attempts.LastFailedAt.Equal(now.Add(4*time.Second)) {
+		t.Fatalf("GetAttempts after RefundAttempt of an earlier attempt returned %+v, %v", attempts, err)
+	}
+
+	if err := s.RefundAttempt(ctx, "ip:192.0.2.3", now, Attempts{}); err != nil {
+		t.Fatalf("RefundAttempt of unknown key: %v", err)
+	}
+	if attempts, err := s.GetAttempts(ctx, "ip:192.0.2.3"); err != nil || attempts.Failures != 0 {
+		t.Fatalf("GetAttempts after RefundAttempt of unknown key returned %+v, %v", attempts, err)
+	}
+
+	if attempts, err := s.GetAttempts(ctx, "ip:192.0.2.2"); err != nil || attempts.Failures != 0 {
+		t.Fatalf("GetAttempts of other key returned %+v, %v", attempts, err)
+	}
+
+	testConcurrentReserve(t, s)
+}
+
+// testConcurrentReserve enters codes in parallel, each of which must see every attempt reserved before it.
+func testConcurrentReserve(t *testing.T, s FlowStore) {
+	ctx := context.Background()
+
+	const attempts = 20
+	var wg sync.WaitGroup
+	results := make(chan int, attempts)
+	start := make(chan struct{})
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			previous, err := s.ReserveAttempt(ctx, "ip:198.51.100.1", time.Now(), time.Minute)
+			if err != nil {
+				t.Errorf("concurrent ReserveAttempt: %v", err)
+				return
+			}
+			results <- previous.Failures
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+
+	seen := map[int]bool{}
+	for failures := range results {
+		if seen[failures] {
+			t.Errorf("%d attempts before seen by more than one concurrent ReserveAttempt", failures)
+		}
+		seen[failures] = true
+	}
+	if len(seen) != attempts {
+		t.Fatalf("%d of %d concurrent attempts counted", len(seen), attempts)
+	}
+}
+
+// testConcurrentRedeem polls a complete flow in parallel, only one of which may get the token.
+func testConcurrentRedeem(t *testing.T, s FlowStore) {
+	ctx := context.Background()
+
+	flow := Flow{DeviceCode: "concurrent-device-code", UserCode: "CONCURRENT", ClientId: "client", ExpiresAt: time.Now().Add(time.Minute)}
+	if err := s.CreatePendingFlow(ctx, flow, time.Minute); err != nil {
+		t.Fatalf("CreatePendingFlow: %v", err)
+	}
+	got, err := s.GetByDeviceCode(ctx, flow.DeviceCode)
+	if err != nil {
+		t.Fatalf("GetByDeviceCode: %v", err)
+	}
+	if err := s.Complete(ctx, got.DeviceCode, `{"access_token":"token"}`, time.Minute); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+
+	const polls = 20
+	var wg sync.WaitGroup
+	results := make(chan error, polls)
+	start := make(chan struct{})
+	for i := 0; i < polls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := s.Redeem(ctx, got.DeviceCode)
+			results <- err
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+
+	redeemed := 0
+	for err := range results {
+		switch {
+		case err == nil:
+			redeemed++
+		case !errors.Is(err, ErrNotFound):
+			t.Errorf("concurrent Redeem returned %v, want ErrNotFound", err)
+		}
+	}
+	if redeemed != 1 {
+		t.Fatalf("token redeemed %d times by %d concurrent polls, want once", redeemed, polls)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testFlowStore(t, NewMemoryStore(time.Minute, time.Minute))
+}
+
+func TestEncryptedStore(t *testing.T) {
+	ctx := context.Background()
+	k, err := keyring.Ephemeral()
+	if err != nil {
+		t.Fatalf("Ephemeral: %v", err)
+	}
+
+	inner := NewMemoryStore(time.Minute, time.Minute)
+	testFlowStore(t, NewEncryptedStore(inner, k))
+
+	s := NewEncryptedStore(inner, k)
+	if err := s.CreatePendingFlow(ctx, Flow{DeviceCode: "sealed", UserCode: "SEALED", PkceVerifier: "verifier"}, time.Minute); err != nil {
+		t.Fatalf("CreatePendingFlow: %v", err)
+	}
+	if err := s.Complete(ctx, "sealed", `{"access_token":"token"}`, time.Minute); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+
+	raw, err := inner.GetByDeviceCode(ctx, "sealed")
+	if err != nil {
+		t.Fatalf("GetByDeviceCode: %v", err)
+	}
+	if !keyring.IsSealed(raw.PkceVerifier) || !keyring.IsSealed(raw.TokenResponse) {
+		t.Fatalf("sensitive fields stored in plain text: %+v", raw)
+	}
+
+	// A sealed value moved onto another flow by someone writing to the store must not open
+	if err := s.CreatePendingFlow(ctx, Flow{DeviceCode: "victim", UserCode: "VICTIM"}, time.Minute); err != nil {
+		t.Fatalf("CreatePendingFlow: %v", err)
+	}
+	if err := inner.Complete(ctx, "victim", raw.TokenResponse, time.Minute); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if _, err := s.GetByDeviceCode(ctx, "victim"); err == nil {
+		t.Fatalf("token response sealed for another flow opened")
+	}
+}
+
+func TestHashedStore(t *testing.T) {
+	ctx := context.Background()
+
+	inner := NewMemoryStore(time.Minute, time.Minute)
+	testFlowStore(t, NewHashedStore(inner, []byte("secret")))
+
+	s := NewHashedStore(inner, []byte("secret"))
+	if err := s.CreatePendingFlow(ctx, Flow{DeviceCode: "hashed", UserCode: "HASHED"}, time.Minute); err != nil {
+		t.Fatalf("CreatePendingFlow: %v", err)
+	}
+
+	if _, err := inner.GetByDeviceCode(ctx, "hashed"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("raw device code is a key in the wrapped store, got %v", err)
+	}
+	if _, err := inner.GetByUserCode(ctx, "HASHED"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("raw user code is a key in the wrapped store, got %v", err)
+	}
+
+	other := NewHashedStore(inner, []byte("other secret"))
+	if _, err := other.GetByDeviceCode(ctx, "hashed"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("device code found with another hash key, got %v", err)
+	}
+}